@@ -0,0 +1,114 @@
+package nginxgo
+
+import (
+	"time"
+
+	"github.com/hellobchain/nginxgo/core"
+	"github.com/spf13/cobra"
+)
+
+func configCMD() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "manage nginxgo config",
+		Long:  "manage nginxgo config",
+	}
+	configCmd.AddCommand(convertCMD())
+	configCmd.AddCommand(historyCMD())
+	configCmd.AddCommand(rollbackCMD())
+	configCmd.AddCommand(distributionCMD())
+	return configCmd
+}
+
+func convertCMD() *cobra.Command {
+	convertCmd := &cobra.Command{
+		Use:   "convert <src> <dst>",
+		Short: "convert nginxgo config between formats",
+		Long:  "convert nginxgo config between .cfg, .conf, .json and .yaml, the output format is chosen by the extension of dst (.cfg, .json, .yaml or .yml)",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := core.ConvertConfig(args[0], args[1])
+			if err != nil {
+				logger.Errorf("nginxgo: convert %s to %s failed:\n%v", args[0], args[1], err)
+				return err
+			}
+			logger.Infof("nginxgo: converted %s to %s", args[0], args[1])
+			return nil
+		},
+	}
+	return convertCmd
+}
+
+func historyCMD() *cobra.Command {
+	historyCmd := &cobra.Command{
+		Use:   "history",
+		Short: "list applied nginxgo config snapshots",
+		Long:  "list every successfully applied nginxgo config snapshot with id, time and content hash",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			snapshots, err := core.ListSnapshots()
+			if err != nil {
+				logger.Error("nginxgo: read config history error:", err)
+				return err
+			}
+			if len(snapshots) == 0 {
+				logger.Info("nginxgo: no config snapshot in ", core.ConfigHistoryDir)
+			}
+			for _, snapshot := range snapshots {
+				logger.Infof("%s  %s  %s  %s", snapshot.ID, snapshot.Time.Format(time.RFC3339), snapshot.Hash[:12], snapshot.Source)
+			}
+			return nil
+		},
+	}
+	attachFlags(historyCmd, []string{flagNameOfHistoryDir})
+	return historyCmd
+}
+
+func rollbackCMD() *cobra.Command {
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback <id>",
+		Short: "rollback nginxgo config to a snapshot",
+		Long:  "restore a config snapshot into the config file (the old file is kept as .bak) and reset the running nginxgo",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := core.RestoreSnapshot(args[0], core.NginxConfigFilepath)
+			if err != nil {
+				logger.Errorf("nginxgo: rollback to %s failed: %v", args[0], err)
+				return err
+			}
+			logger.Infof("nginxgo: restored snapshot %s into %s", args[0], core.NginxConfigFilepath)
+			pid, err := readPidFile()
+			if err != nil {
+				logger.Warn("nginxgo: read pid file error, the restored config will be used at next start:", err)
+				return nil
+			}
+			sendSignalHup(pid)
+			return nil
+		},
+	}
+	attachFlags(rollbackCmd, []string{flagNameOfConfigFilepath, flagNameOfPidFilePath, flagNameOfHistoryDir})
+	return rollbackCmd
+}
+
+func distributionCMD() *cobra.Command {
+	distributionCmd := &cobra.Command{
+		Use:   "distribution [upstream]",
+		Short: "compare key distribution of the hash policies",
+		Long:  "simulate hash keys against each upstream with ip_hash, maglev and jump_hash, report the share of every backend and how many keys move when a backend is removed",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := ""
+			if len(args) == 1 {
+				name = args[0]
+			}
+			report, err := core.DistributionReport(core.NginxConfigFilepath, name, distributionKeys)
+			if err != nil {
+				logger.Error("nginxgo: distribution report error:", err)
+				return err
+			}
+			logger.Infof("nginxgo: distribution report\n%s", report)
+			return nil
+		},
+	}
+	attachFlags(distributionCmd, []string{flagNameOfConfigFilepath, flagNameOfDistributionKeys})
+	return distributionCmd
+}
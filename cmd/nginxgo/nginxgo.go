@@ -30,9 +30,34 @@ const (
 
 	// pidFilePath 是 pid 文件路径
 	flagNameShortHandOfPidFilePath = "p"
+
+	// flagNameOfTestConfig 只检查配置文件，不启动服务
+	flagNameOfTestConfig = "test-config"
+
+	// flagNameShortHandOfTestConfig 是检查配置文件的短名称
+	flagNameShortHandOfTestConfig = "t"
+
+	// flagNameOfWatchConfig 监听配置文件变化，自动热重启
+	flagNameOfWatchConfig = "watch"
+
+	// flagNameShortHandOfWatchConfig 是监听配置文件的短名称
+	flagNameShortHandOfWatchConfig = "w"
+
+	// flagNameOfHistoryDir 是配置快照目录的标志名称
+	flagNameOfHistoryDir = "history-dir"
+
+	// flagNameOfDistributionKeys 是分布报告模拟的哈希键数量
+	flagNameOfDistributionKeys = "keys"
+
+	// flagNameOfAdminAddr 是管理接口的监听地址，只允许本机地址
+	flagNameOfAdminAddr = "admin"
 )
 
 var pidFilePath string
+var testConfigOnly bool
+var distributionKeys int
+var watchConfig bool
+var adminAddr string
 
 func operateCMD(command string, pid int) {
 	switch command {
@@ -41,6 +66,14 @@ func operateCMD(command string, pid int) {
 		if engine == nil {
 			engine = core.Init()
 			go engine.Start()
+			if watchConfig {
+				engine.Watch()
+			}
+			if adminAddr != "" {
+				if err := engine.ServeAdmin(adminAddr); err != nil {
+					logger.Error("nginxgo: start admin api error:", err)
+				}
+			}
 		} else {
 			logger.Warn("nginxgo: engine already started")
 		}
@@ -83,11 +116,19 @@ func operateCMD(command string, pid int) {
 			}
 			mu.Unlock()
 		}
+	case constant.CMD_TEST:
+		err := core.CheckConfig(core.NginxConfigFilepath)
+		if err != nil {
+			logger.Errorf("nginxgo: configuration file %s test failed:\n%v", core.NginxConfigFilepath, err)
+			os.Exit(1)
+		}
+		logger.Infof("nginxgo: configuration file %s test is successful", core.NginxConfigFilepath)
 	case constant.CMD_HELP:
 		logger.Info("nginxgo help")
 		logger.Info("nginxgo start")
 		logger.Info("nginxgo stop")
 		logger.Info("nginxgo reset")
+		logger.Info("nginxgo test")
 	default:
 		logger.Error("nginxgo: error command")
 	}
@@ -98,6 +139,8 @@ func StartMain() {
 	mainCmd.AddCommand(startCMD())
 	mainCmd.AddCommand(stopCMD())
 	mainCmd.AddCommand(resetCMD())
+	mainCmd.AddCommand(testCMD())
+	mainCmd.AddCommand(configCMD())
 	mainCmd.AddCommand(helpCMD())
 	err := mainCmd.Execute()
 	if err != nil {
@@ -111,13 +154,17 @@ func startCMD() *cobra.Command {
 		Short: "Startup nginxgo",
 		Long:  "Startup nginxgo",
 		RunE: func(cmd *cobra.Command, _ []string) error {
+			if testConfigOnly {
+				operateCMD(constant.CMD_TEST, -1)
+				return nil
+			}
 			operateCMD(constant.CMD_START, -1)
 			logger.Error("nginxgo exit")
 			return nil
 		},
 	}
 
-	attachFlags(startCmd, []string{flagNameOfConfigFilepath})
+	attachFlags(startCmd, []string{flagNameOfConfigFilepath, flagNameOfTestConfig, flagNameOfWatchConfig, flagNameOfHistoryDir, flagNameOfAdminAddr})
 	return startCmd
 }
 
@@ -155,14 +202,32 @@ func resetCMD() *cobra.Command {
 		Short: "reset nginxgo",
 		Long:  "reset nginxgo",
 		RunE: func(cmd *cobra.Command, _ []string) error {
+			if testConfigOnly {
+				operateCMD(constant.CMD_TEST, -1)
+				return nil
+			}
 			operateCMD(constant.CMD_RESET, 1)
 			return nil
 		},
 	}
-	attachFlags(resetCmd, []string{flagNameOfConfigFilepath, flagNameOfPidFilePath})
+	attachFlags(resetCmd, []string{flagNameOfConfigFilepath, flagNameOfPidFilePath, flagNameOfTestConfig})
 	return resetCmd
 }
 
+func testCMD() *cobra.Command {
+	testCmd := &cobra.Command{
+		Use:   "test",
+		Short: "test nginxgo config",
+		Long:  "parse and validate nginxgo config, report every error with file and line number",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			operateCMD(constant.CMD_TEST, -1)
+			return nil
+		},
+	}
+	attachFlags(testCmd, []string{flagNameOfConfigFilepath})
+	return testCmd
+}
+
 func helpCMD() *cobra.Command {
 	helpCmd := &cobra.Command{
 		Use:   "help",
@@ -182,6 +247,16 @@ func initFlagSet() *pflag.FlagSet {
 		"./configs/config.cfg", "specify config file path, if not set, default use ./configs/config.cfg")
 	flags.StringVarP(&pidFilePath, flagNameOfPidFilePath, flagNameShortHandOfPidFilePath,
 		"./nginxgo.pid", "specify pid file path, if not set, default use ./nginxgo.pid")
+	flags.BoolVarP(&testConfigOnly, flagNameOfTestConfig, flagNameShortHandOfTestConfig,
+		false, "test config file and exit")
+	flags.StringVar(&core.ConfigHistoryDir, flagNameOfHistoryDir,
+		"./configs/history", "specify directory of applied config snapshots, if not set, default use ./configs/history")
+	flags.BoolVarP(&watchConfig, flagNameOfWatchConfig, flagNameShortHandOfWatchConfig,
+		false, "reset automatically when the config file or any included file changes")
+	flags.IntVar(&distributionKeys, flagNameOfDistributionKeys,
+		100000, "number of simulated hash keys in the distribution report")
+	flags.StringVar(&adminAddr, flagNameOfAdminAddr,
+		"", "listen address of the admin api, e.g. 127.0.0.1:9090, only loopback addresses are allowed, disabled if not set")
 	return flags
 }
 
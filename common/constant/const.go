@@ -1,10 +1,13 @@
 package constant
 
+import "time"
+
 const (
 	CMD_START = "start"
 	CMD_RESET = "reset"
 	CMD_STOP  = "stop"
 	CMD_HELP  = "help"
+	CMD_TEST  = "test"
 )
 
 // location type描述
@@ -30,6 +33,15 @@ const (
 	BLOCK_UPSTREAM_SCHEMA   = "schema"
 	BLOCK_UPSTREAM_REPLICAS = "replicas"
 
+	BLOCK_UPSTREAM_DEFAULT         = "[upstream_default]" // 所有upstream共用的默认配置
+	BLOCK_UPSTREAM_CONNECT_TIMEOUT = "connect_timeout"
+	BLOCK_UPSTREAM_READ_TIMEOUT    = "read_timeout"
+	BLOCK_UPSTREAM_POLICY          = "policy"
+	BLOCK_UPSTREAM_HASH_KEY        = "hash_key"    // 哈希键模板，例如"$cookie_user"、"$http_x_tenant:$uri"
+	BLOCK_UPSTREAM_LOAD_FACTOR     = "load_factor" // 有界负载一致性哈希的负载系数，例如1.25
+	BLOCK_UPSTREAM_FAIL_STATUS     = "fail_status" // 记为失败的响应状态码，例如"500,502-504"
+	BLOCK_UPSTREAM_SLOW_START      = "slow_start"  // 恢复或者新加入的后端服务器流量从0增加到完整的时长
+
 	BLOCK_LOCATION           = "[location]"
 	BLOCK_LOCATION_TYPE      = "type"
 	BLOCK_LOCATION_ROOT      = "root"
@@ -40,8 +52,211 @@ const (
 	BLOCK_PROXY_SET_HEADER_KEY   = "key"
 	BLOCK_PROXY_SET_HEADER_VALUE = "value"
 	BLOCK_END                    = "[end]"
+	BLOCK_INCLUDE                = "include" // "include 路径"，支持glob
+)
+
+// 负载均衡策略
+const (
+	POLICY_IP_HASH              = "ip_hash"   // 按哈希键（默认为客户端ip）在哈希环上查找，默认策略
+	POLICY_MAGLEV               = "maglev"    // Maglev查找表一致性哈希
+	POLICY_JUMP_HASH            = "jump_hash" // jump consistent hash
+	POLICY_ROUND_ROBIN          = "round_robin"
+	POLICY_WEIGHTED_ROUND_ROBIN = "weighted_round_robin"
+	POLICY_LEAST_CONN           = "least_conn"
+	POLICY_RANDOM               = "random"
+	POLICY_P2C                  = "p2c"       // power of two choices，随机选两个取负载较低的
+	POLICY_PEAK_EWMA            = "peak_ewma" // 随机选两个，取 响应时间的peak EWMA*(正在处理的请求数+1)/权重 较低的
+)
+
+// 主动健康检查，配置项写在upstream块中，例如"health_check=/healthz"
+const (
+	HEALTH_CHECK          = "health_check"          // 检查路径，设置后开启健康检查
+	HEALTH_CHECK_INTERVAL = "health_check_interval" // 检查间隔
+	HEALTH_CHECK_TIMEOUT  = "health_check_timeout"  // 单次检查超时
+	HEALTH_CHECK_STATUS   = "health_check_status"   // 健康的状态码，例如"200-399"、"200,204"
+	HEALTH_CHECK_BODY     = "health_check_body"     // 响应体需要匹配的正则表达式
+	HEALTH_CHECK_RISE     = "health_check_rise"     // 连续成功多少次后恢复
+	HEALTH_CHECK_FALL     = "health_check_fall"     // 连续失败多少次后摘除
+
+	DEFAULT_HEALTH_CHECK_INTERVAL = 5 * time.Second
+	DEFAULT_HEALTH_CHECK_TIMEOUT  = 2 * time.Second
+	DEFAULT_HEALTH_CHECK_STATUS   = "200-399"
+	DEFAULT_HEALTH_CHECK_RISE     = 2
+	DEFAULT_HEALTH_CHECK_FALL     = 3
+	HEALTH_CHECK_MAX_BODY         = 64 * 1024 // 匹配响应体时最多读取的字节数
+)
+
+// 请求失败时重试下一个后端服务器，配置项写在upstream块中，例如"proxy_next_upstream=error timeout http_502"
+const (
+	NEXT_UPSTREAM           = "proxy_next_upstream"           // 重试的条件
+	NEXT_UPSTREAM_TRIES     = "proxy_next_upstream_tries"     // 最多尝试的后端服务器数量，0表示不限制
+	NEXT_UPSTREAM_TIMEOUT   = "proxy_next_upstream_timeout"   // 重试的总时长，0表示不限制
+	NEXT_UPSTREAM_BODY_SIZE = "proxy_next_upstream_body_size" // 为了重试缓存的请求体大小上限，例如"64k"、"1m"，超过时不重试
+
+	NEXT_UPSTREAM_ERROR          = "error"          // 连接错误
+	NEXT_UPSTREAM_TIMEOUT_ERROR  = "timeout"        // 超时
+	NEXT_UPSTREAM_HTTP_PREFIX    = "http_"          // 状态码，例如"http_502"
+	NEXT_UPSTREAM_NON_IDEMPOTENT = "non_idempotent" // POST等非幂等请求也重试
+	NEXT_UPSTREAM_OFF            = "off"            // 不重试
+
+	DEFAULT_NEXT_UPSTREAM           = "error timeout"
+	DEFAULT_NEXT_UPSTREAM_BODY_SIZE = 64 * 1024
+)
+
+// 每个后端服务器的熔断器，配置项写在upstream块中，设置任意一项即开启
+const (
+	CIRCUIT_BREAKER                      = "circuit_breaker"                      // 配置项的前缀
+	CIRCUIT_BREAKER_WINDOW               = "circuit_breaker_window"               // 统计错误率的滑动窗口
+	CIRCUIT_BREAKER_ERROR_RATE           = "circuit_breaker_error_rate"           // 窗口内错误率达到多少时熔断，例如0.5
+	CIRCUIT_BREAKER_MIN_REQUESTS         = "circuit_breaker_min_requests"         // 窗口内请求数达到多少才按错误率熔断
+	CIRCUIT_BREAKER_CONSECUTIVE_FAILURES = "circuit_breaker_consecutive_failures" // 连续失败多少次时熔断，0表示不按连续失败熔断
+	CIRCUIT_BREAKER_OPEN_TIMEOUT         = "circuit_breaker_open_timeout"         // 熔断多久之后进入半开状态
+	CIRCUIT_BREAKER_HALF_OPEN_REQUESTS   = "circuit_breaker_half_open_requests"   // 半开状态放行的探测请求数，全部成功后恢复
+
+	DEFAULT_CIRCUIT_BREAKER_WINDOW               = 10 * time.Second
+	DEFAULT_CIRCUIT_BREAKER_ERROR_RATE           = 0.5
+	DEFAULT_CIRCUIT_BREAKER_MIN_REQUESTS         = 20
+	DEFAULT_CIRCUIT_BREAKER_CONSECUTIVE_FAILURES = 5
+	DEFAULT_CIRCUIT_BREAKER_OPEN_TIMEOUT         = 30 * time.Second
+	DEFAULT_CIRCUIT_BREAKER_HALF_OPEN_REQUESTS   = 1
+	CIRCUIT_BREAKER_BUCKETS                      = 10               // 滑动窗口分成的桶数
+	MIN_CIRCUIT_BREAKER_WINDOW                   = time.Second      // 滑动窗口的最小值
+	MIN_CIRCUIT_BREAKER_BUCKET                   = time.Millisecond // 每个桶的最小时长
+)
+
+// 后端服务器响应时间和错误率的指数加权移动平均（EWMA）
+const (
+	EWMA_DECAY       = 10 * time.Second // 响应时间的衰减时间常数，越久之前的样本权重越低
+	EWMA_ERROR_ALPHA = 0.05             // 每个请求结果在错误率中的权重
+)
+
+// 异常检测：响应时间或者错误率明显偏高的后端服务器暂时摘除，配置项写在upstream块中，设置任意一项即开启
+const (
+	OUTLIER_DETECTION                      = "outlier_detection"                      // 配置项的前缀
+	OUTLIER_DETECTION_INTERVAL             = "outlier_detection_interval"             // 检测间隔
+	OUTLIER_DETECTION_LATENCY_FACTOR       = "outlier_detection_latency_factor"       // 响应时间超过其他后端服务器中位数的多少倍时摘除，0表示不按响应时间摘除
+	OUTLIER_DETECTION_ERROR_RATE           = "outlier_detection_error_rate"           // 错误率达到多少时摘除，0表示不按错误率摘除
+	OUTLIER_DETECTION_MIN_REQUESTS         = "outlier_detection_min_requests"         // 检测间隔内请求数达到多少才参与检测
+	OUTLIER_DETECTION_EJECTION_TIME        = "outlier_detection_ejection_time"        // 摘除时长
+	OUTLIER_DETECTION_MAX_EJECTION_PERCENT = "outlier_detection_max_ejection_percent" // 同时最多摘除的后端服务器比例
+
+	DEFAULT_OUTLIER_DETECTION_INTERVAL             = 10 * time.Second
+	DEFAULT_OUTLIER_DETECTION_LATENCY_FACTOR       = 3.0
+	DEFAULT_OUTLIER_DETECTION_ERROR_RATE           = 0.5
+	DEFAULT_OUTLIER_DETECTION_MIN_REQUESTS         = 20
+	DEFAULT_OUTLIER_DETECTION_EJECTION_TIME        = 30 * time.Second
+	DEFAULT_OUTLIER_DETECTION_MAX_EJECTION_PERCENT = 50
+)
+
+// 服务发现：从文件或者DNS获取后端服务器，配置项写在upstream块中，与静态的后端服务器合并
+const (
+	DISCOVERY            = "discovery"            // 配置项的前缀
+	DISCOVERY_FILE       = "discovery_file"       // 后端服务器列表文件，JSON字符串数组或者每行一个，写法与配置中的一行相同
+	DISCOVERY_DNS        = "discovery_dns"        // 解析的域名，A/AAAA记录为"域名:端口"，SRV记录为完整的SRV名称
+	DISCOVERY_DNS_TYPE   = "discovery_dns_type"   // 记录类型
+	DISCOVERY_DNS_SERVER = "discovery_dns_server" // DNS服务器地址，例如"127.0.0.1:53"，不设置时使用系统配置
+	DISCOVERY_INTERVAL   = "discovery_interval"   // 刷新间隔
+	DISCOVERY_ATTRIBUTES = "discovery_attributes" // 附加给每个发现的后端服务器的属性，例如"max_fails=2 fail_timeout=5s"
+
+	DNS_TYPE_IP   = "ip"   // A和AAAA记录，默认
+	DNS_TYPE_A    = "a"    // 只用A记录
+	DNS_TYPE_AAAA = "aaaa" // 只用AAAA记录
+	DNS_TYPE_SRV  = "srv"  // SRV记录，使用记录中的端口和权重，优先级最高（数值最小）的为主服务器，其余为备用服务器
+
+	DEFAULT_DISCOVERY_INTERVAL = 10 * time.Second
+	DISCOVERY_TIMEOUT          = 5 * time.Second // 单次刷新超时
+)
+
+// 会话保持，配置项写在upstream块中，例如"sticky=cookie route expires=1h"
+const (
+	STICKY          = "sticky"        // 会话保持方式和参数
+	STICKY_SECRET   = "sticky_secret" // 签名cookie的密钥，可以用${file:路径}引用密钥文件
+	STICKY_COOKIE   = "cookie"        // 用签名的cookie记录选中的后端服务器
+	STICKY_EXPIRES  = "expires"       // cookie有效期，不设置时为会话cookie
+	STICKY_PATH     = "path"          // cookie路径，默认"/"
+	STICKY_DOMAIN   = "domain"        // cookie域名
+	STICKY_SECURE   = "secure"        // 只通过https发送
+	STICKY_HTTPONLY = "httponly"      // 不允许脚本读取
+
+	STICKY_ID_BYTES = 12       // cookie中后端服务器标识（HMAC-SHA256截断）的字节数
+	MASKED_VALUE    = "******" // 日志中代替签名密钥输出
+)
+
+// 管理接口，运行时修改后端服务器池的成员
+const (
+	ADMIN_PATH_UPSTREAMS = "/upstreams" // 所有后端服务器池，"/upstreams/池名"为一个后端服务器池
+	ADMIN_PATH_BACKENDS  = "backends"   // "/upstreams/池名/backends"添加，"/upstreams/池名/backends/地址"删除
+	ADMIN_PATH_WEIGHT    = "weight"     // "/upstreams/池名/backends/地址/weight"修改权重
+	ADMIN_PATH_DRAIN     = "drain"      // "/upstreams/池名/backends/地址/drain"摘除（POST）或者恢复（DELETE）
+	ADMIN_QUERY_PERSIST  = "persist"    // "?persist=true"同时写回配置文件
+)
+
+// 所有后端服务器都不可用时返回的响应，配置项写在upstream块中
+const (
+	FALLBACK        = "fallback"        // 配置项的前缀
+	FALLBACK_STATUS = "fallback_status" // 状态码，默认503
+	FALLBACK_BODY   = "fallback_body"   // 响应体
+	FALLBACK_FILE   = "fallback_file"   // 响应体文件，例如维护页面，优先于fallback_body
+
+	DEFAULT_FALLBACK_STATUS = 503
+)
+
+// 哈希键模板中的变量，与nginx的变量名一致
+const (
+	HASH_KEY_REMOTE_ADDR   = "remote_addr" // 客户端ip
+	HASH_KEY_HOST          = "host"
+	HASH_KEY_URI           = "uri"         // 路径，不带参数
+	HASH_KEY_REQUEST_URI   = "request_uri" // 路径和参数
+	HASH_KEY_HTTP_PREFIX   = "http_"       // 请求头，例如"$http_x_user"对应X-User
+	HASH_KEY_COOKIE_PREFIX = "cookie_"     // cookie，例如"$cookie_session"
+	HASH_KEY_ARG_PREFIX    = "arg_"        // 查询参数，例如"$arg_id"
 )
 
+// 后端服务器属性，例如"127.0.0.1:8080 weight=5 max_fails=3 backup"
+const (
+	BACKEND_WEIGHT       = "weight"       // 权重，影响哈希环的虚拟节点数和其他策略的流量比例
+	BACKEND_MAX_FAILS    = "max_fails"    // fail_timeout内失败多少次后暂停使用，0表示不暂停
+	BACKEND_FAIL_TIMEOUT = "fail_timeout" // 统计失败次数的时间窗口，也是暂停使用的时长
+	BACKEND_BACKUP       = "backup"       // 备用服务器，其他服务器都不可用时才使用
+
+	DEFAULT_BACKEND_WEIGHT       = 1
+	DEFAULT_BACKEND_MAX_FAILS    = 3
+	DEFAULT_BACKEND_FAIL_TIMEOUT = 10 * time.Second
+)
+
+// 配置文件方言
+const (
+	DIALECT_HEADER = "dialect=" // 配置文件首行的方言声明，例如"# dialect=nginx"
+	DIALECT_CFG    = "cfg"      // [server]/[end]风格
+	DIALECT_NGINX  = "nginx"    // nginx花括号风格
+	DIALECT_JSON   = "json"
+	DIALECT_YAML   = "yaml"
+)
+
+// nginx风格配置的指令
+const (
+	DIRECTIVE_SERVER           = "server"
+	DIRECTIVE_LISTEN           = "listen"
+	DIRECTIVE_LOCATION         = "location"
+	DIRECTIVE_PROXY_PASS       = "proxy_pass"
+	DIRECTIVE_FILE_ROOT        = "file_root"
+	DIRECTIVE_UPSTREAM         = "upstream"
+	DIRECTIVE_UPSTREAM_DEFAULT = "upstream_default"
+	DIRECTIVE_REPLICAS         = "replicas"
+	DIRECTIVE_SCHEME           = "scheme"
+	DIRECTIVE_PROXY_SET_HEADER = "proxy_set_header"
+	DIRECTIVE_INCLUDE          = "include"
+)
+
+// 配置文件监听
+const (
+	WATCH_INTERVAL = 500 * time.Millisecond // 检查文件变化的间隔
+	WATCH_DEBOUNCE = time.Second            // 文件停止变化多久之后才热重启，避免连续写入时多次重启
+)
+
+// 最多保留的配置快照数量
+const MAX_CONFIG_SNAPSHOTS = 100
+
 // 日志切割默认配置
 const (
 	DEFAULT_MAX_AGE       = 7   // 日志最长保存时间，单位：天
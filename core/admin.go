@@ -0,0 +1,383 @@
+package core
+
+//管理接口：运行时查看和修改后端服务器池的成员，只监听本机地址
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 一个后端服务器的状态
+type adminBackend struct {
+	Server    string  `json:"server"` //配置中的一行，带属性
+	Addr      string  `json:"addr"`
+	Weight    int     `json:"weight"`
+	Backup    bool    `json:"backup,omitempty"`
+	Available bool    `json:"available"`
+	Draining  bool    `json:"draining,omitempty"`
+	Inflight  int64   `json:"inflight"`
+	Latency   string  `json:"latency,omitempty"` //响应时间的EWMA
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// 一个后端服务器池的状态
+type adminUpstream struct {
+	Name     string         `json:"name"`
+	Policy   string         `json:"policy,omitempty"`
+	Backends []adminBackend `json:"backends"`
+}
+
+// 修改权重的请求体
+type adminWeight struct {
+	Weight int `json:"weight"`
+}
+
+// 添加后端服务器的请求体，server与配置中的一行相同，例如"127.0.0.1:8082 weight=2"
+type adminServer struct {
+	Server string `json:"server"`
+}
+
+// ServeAdmin 在addr上启动管理接口，只允许本机地址，引擎停止时关闭
+func (e *Engine) ServeAdmin(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid admin address %q: %v", addr, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("admin address %q must be a loopback address", addr)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return fmt.Errorf("listen admin address %s failed: %v", addr, err)
+	}
+	server := &http.Server{Handler: e.adminHandler()}
+	go func() {
+		<-e.done
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("管理接口错误：", err)
+		}
+	}()
+	logger.Info("管理接口监听", listener.Addr())
+	return nil
+}
+
+func (e *Engine) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(constant.ADMIN_PATH_UPSTREAMS, e.handleAdmin)
+	mux.HandleFunc(constant.ADMIN_PATH_UPSTREAMS+"/", e.handleAdmin)
+	return mux
+}
+
+// 按路径分发：
+// GET /upstreams、GET /upstreams/池名、POST /upstreams/池名/backends、DELETE /upstreams/池名/backends/地址、
+// PUT /upstreams/池名/backends/地址/weight、POST和DELETE /upstreams/池名/backends/地址/drain
+func (e *Engine) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if status, err := checkAdminRequest(r); err != nil {
+		adminError(w, status, err)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, constant.ADMIN_PATH_UPSTREAMS), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			adminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		var result []adminUpstream
+		for _, name := range sortedKeys(e.upstream.all()) {
+			result = append(result, e.upstream.get(name).status())
+		}
+		adminJSON(w, http.StatusOK, result)
+		return
+	}
+	parts := strings.Split(path, "/")
+	name := parts[0]
+	persist, _ := strconv.ParseBool(r.URL.Query().Get(constant.ADMIN_QUERY_PERSIST))
+	var err error
+	status := http.StatusOK
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+	case len(parts) == 2 && parts[1] == constant.ADMIN_PATH_BACKENDS && r.Method == http.MethodPost:
+		var body adminServer
+		if err = decodeAdmin(r, &body); err == nil {
+			err = e.updateMembers(name, persist, addBackend(body.Server))
+			status = http.StatusCreated
+		}
+	case len(parts) == 3 && parts[1] == constant.ADMIN_PATH_BACKENDS && r.Method == http.MethodDelete:
+		err = e.updateMembers(name, persist, removeBackend(parts[2]))
+	case len(parts) == 4 && parts[1] == constant.ADMIN_PATH_BACKENDS && parts[3] == constant.ADMIN_PATH_WEIGHT && r.Method == http.MethodPut:
+		var body adminWeight
+		if err = decodeAdmin(r, &body); err == nil {
+			err = e.updateMembers(name, persist, setBackendWeight(parts[2], body.Weight))
+		}
+	case len(parts) == 4 && parts[1] == constant.ADMIN_PATH_BACKENDS && parts[3] == constant.ADMIN_PATH_DRAIN &&
+		(r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		err = e.drain(name, parts[2], r.Method == http.MethodPost)
+	default:
+		adminError(w, http.StatusNotFound, fmt.Errorf("%s %s %w", r.Method, r.URL.Path, errNotFound))
+		return
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, errExists):
+			status = http.StatusConflict
+		case errors.Is(err, errLastBackend):
+			status = http.StatusConflict
+		case errors.Is(err, errInvalidConfig):
+			status = http.StatusUnprocessableEntity
+		case errors.Is(err, errNotPersisted):
+			status = http.StatusInternalServerError
+		default:
+			status = http.StatusBadRequest
+		}
+		adminError(w, status, err)
+		return
+	}
+	upstream := e.upstream.get(name)
+	if upstream == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("upstream %s %w", name, errNotFound))
+		return
+	}
+	adminJSON(w, status, upstream.status())
+}
+
+// 防止浏览器中的网页跨站调用管理接口：Host必须是本机地址（防DNS重绑定），
+// 修改类的请求必须是application/json（简单请求不能带这个类型，跨站时会先发预检请求）
+func checkAdminRequest(r *http.Request) (int, error) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !isLoopbackHost(strings.Trim(host, "[]")) {
+		return http.StatusForbidden, fmt.Errorf("host %q is not allowed", r.Host)
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return 0, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("content type %q is not allowed, must be application/json", r.Header.Get("Content-Type"))
+	}
+	return 0, nil
+}
+
+// 是否为本机的主机名或IP
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+var (
+	errNotPersisted  = errors.New("not persisted")
+	errInvalidConfig = errors.New("would make the config invalid")
+	errLastBackend   = errors.New("has no other primary backend")
+)
+
+// 修改后端服务器列表，persist为true时先写回配置文件，写回失败时不修改运行时的列表。与热重启互斥
+func (e *Engine) updateMembers(name string, persist bool, op func([]string) ([]string, error)) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	upstream := e.upstream.get(name)
+	if upstream == nil {
+		return fmt.Errorf("upstream %s %w", name, errNotFound)
+	}
+	//先在当前列表上试一次，不能删掉最后一个主服务器（服务发现的后端服务器池除外）
+	lines, err := op(upstream.backends())
+	if err != nil {
+		return err
+	}
+	if upstream.Discovery == nil && !hasPrimary(lines) {
+		return fmt.Errorf("upstream %s %w", name, errLastBackend)
+	}
+	if persist {
+		cfg, err := persistMembers(NginxConfigFilepath, name, op)
+		if err != nil {
+			if !errors.Is(err, errInvalidConfig) {
+				err = fmt.Errorf("%w: %v", errNotPersisted, err)
+			}
+			return err
+		}
+		recordSnapshot(snapshotConfig(cfg))
+	}
+	if err := upstream.update(op); err != nil {
+		return err
+	}
+	logger.Info("管理接口：后端服务器池", name, "修改为", upstream.backends())
+	return nil
+}
+
+// 列表中是否还有不是backup的后端服务器
+func hasPrimary(lines []string) bool {
+	for _, line := range lines {
+		if b, err := parseBackend(line); err == nil && !b.backup {
+			return true
+		}
+	}
+	return false
+}
+
+// 当前的后端服务器列表
+func (upstream *upstream) backends() []string {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	return append([]string{}, upstream.Addr...)
+}
+
+// 把修改应用到配置文件中的后端服务器池，原文件备份为.bak。
+// 输出格式与原文件相同，注释不会保留，使用include的配置文件不支持。
+// 写入前按nginxgo test的方式校验，不通过时不修改文件。返回校验时加载的配置，用于保存快照
+func persistMembers(fileName, name string, op func([]string) ([]string, error)) (config, error) {
+	reader := &configReader{raw: true}
+	cfg, err := reader.parse(fileName)
+	if err != nil {
+		return config{}, err
+	}
+	//不替换变量时files里只有配置文件，多于一个说明用了include
+	if len(reader.files) > 1 || len(reader.globs) > 0 {
+		return config{}, fmt.Errorf("%s uses include, edit it manually", fileName)
+	}
+	upstream := cfg.Upstream[name]
+	if upstream == nil {
+		return config{}, fmt.Errorf("upstream %s is not defined in %s", name, fileName)
+	}
+	if upstream.Addr, err = op(upstream.Addr); err != nil {
+		return config{}, err
+	}
+	data, err := marshalConfig(cfg, fileName)
+	if err != nil {
+		return config{}, err
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return config{}, err
+	}
+	old, err := os.ReadFile(fileName)
+	if err != nil {
+		return config{}, err
+	}
+	//先写到同目录的临时文件（文件名后缀不变，方言相同）校验，通过后再替换
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), ".*-"+filepath.Base(fileName))
+	if err != nil {
+		return config{}, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return config{}, err
+	}
+	applied, err := loadConfig(tmp.Name())
+	if err != nil {
+		//错误中的临时文件名换成配置文件名
+		return config{}, fmt.Errorf("%w:\n%s", errInvalidConfig, strings.ReplaceAll(err.Error(), tmp.Name(), fileName))
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return config{}, err
+	}
+	if err := os.WriteFile(fileName+".bak", old, info.Mode()); err != nil {
+		return config{}, err
+	}
+	if err := os.Rename(tmp.Name(), fileName); err != nil {
+		return config{}, err
+	}
+	return applied, nil
+}
+
+// 摘除或者恢复一个后端服务器。摘除后不再接收新的请求，正在处理的请求不受影响，只在运行时生效
+func (e *Engine) drain(name, addr string, on bool) error {
+	upstream := e.upstream.get(name)
+	if upstream == nil {
+		return fmt.Errorf("upstream %s %w", name, errNotFound)
+	}
+	for _, p := range upstream.state.Load().peers {
+		if p.addr == addr {
+			p.draining.Store(on)
+			logger.Info("管理接口：后端服务器池", name, "后端服务器", addr, "draining:", on)
+			return nil
+		}
+	}
+	return fmt.Errorf("backend %s %w", addr, errNotFound)
+}
+
+// 后端服务器池的状态
+func (upstream *upstream) status() adminUpstream {
+	upstream.mu.Lock()
+	lines := append([]string{}, upstream.members()...)
+	state := upstream.state.Load()
+	upstream.mu.Unlock()
+	peers := make(map[string]*peer)
+	if state != nil {
+		for _, p := range state.peers {
+			peers[p.addr] = p
+		}
+	}
+	result := adminUpstream{Name: upstream.name, Policy: upstream.Policy, Backends: []adminBackend{}}
+	now := time.Now()
+	for _, line := range lines {
+		p, ok := peers[backendAddr(line)]
+		if !ok {
+			continue
+		}
+		b := adminBackend{
+			Server:    line,
+			Addr:      p.addr,
+			Weight:    p.weight,
+			Backup:    p.backup,
+			Available: p.available(),
+			Draining:  p.draining.Load(),
+			Inflight:  p.inflight.Load(),
+		}
+		latency, errorRate, measured := p.stats.load(now)
+		if measured {
+			b.Latency = time.Duration(latency).Round(time.Microsecond).String()
+		}
+		b.ErrorRate = errorRate
+		result.Backends = append(result.Backends, b)
+	}
+	return result
+}
+
+// 解析JSON请求体
+func decodeAdmin(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
+
+func adminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	adminJSON(w, status, map[string]string{"error": err.Error()})
+}
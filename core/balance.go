@@ -1,40 +1,92 @@
 package core
 
 import (
+	"errors"
+	"fmt"
 	"hash/crc32"
+	"math"
 	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+var (
+	errExists   = errors.New("already exists")
+	errNotFound = errors.New("not found")
 )
 
 // 负载均衡器
 // 哈希环建构
 type hashRing struct {
-	ring  []int          //哈希环
-	nodes map[int]string //节点哈希映射到节点名称
+	ring       []int         //哈希环
+	nodes      map[int]*peer //节点哈希映射到后端服务器
+	peers      []*peer
+	loadFactor float64 //有界负载系数，为0时不限制
 }
 
-// 新增哈希节点，replicas为每个真实节点对应的虚拟节点数
-func (upstream *upstream) addNode() {
-	for _, node := range upstream.Addr {
-		for i := 0; i < upstream.Replicas; i++ {
-			hashValue := int(hash([]byte(strconv.Itoa(i) + node)))
-			upstream.hashRing.ring = append(upstream.hashRing.ring, hashValue)
-			upstream.hashRing.nodes[hashValue] = node
+// 新建哈希环，每个真实节点对应replicas*权重个虚拟节点
+func newHashRing(peers []*peer, upstream *upstream) balancer {
+	hashRing := &hashRing{nodes: make(map[int]*peer), peers: peers, loadFactor: upstream.LoadFactor}
+	for _, node := range peers {
+		for i := 0; i < upstream.Replicas*node.weight; i++ {
+			hashValue := int(hash([]byte(strconv.Itoa(i) + node.addr)))
+			hashRing.ring = append(hashRing.ring, hashValue)
+			hashRing.nodes[hashValue] = node
 		}
 	}
-	sort.Ints(upstream.hashRing.ring)
+	sort.Ints(hashRing.ring)
+	return hashRing
 }
 
-// 均衡器。利用客户端ip计算客户端的哈希值，并且获取顺时针的节点。通过二分查找进行。
-func (hashRing hashRing) balancer(ip string) string {
-	hash := int(hash([]byte(ip)))
+// 均衡器。利用哈希键（默认为客户端ip）计算哈希值，并且获取顺时针的节点。通过二分查找进行。
+// 节点被跳过或者超过负载上限时继续顺时针查找
+func (hashRing *hashRing) pick(key string, skip func(*peer) bool) *peer {
+	if len(hashRing.ring) == 0 {
+		return nil
+	}
+	hash := int(hash([]byte(key)))
 	idx := sort.Search(len(hashRing.ring), func(i int) bool {
 		return hashRing.ring[i] >= hash
 	})
-	if idx == len(hashRing.ring) {
-		idx = 0
+	overloaded := newLoadBound(hashRing.peers, hashRing.loadFactor, skip)
+	var first *peer //所有节点都超过负载上限时使用
+	for i := 0; i < len(hashRing.ring); i++ {
+		node := hashRing.nodes[hashRing.ring[(idx+i)%len(hashRing.ring)]]
+		if skip != nil && skip(node) {
+			continue
+		}
+		if first == nil {
+			first = node
+		}
+		if !overloaded(node) {
+			return node
+		}
+	}
+	return first
+}
+
+// 有界负载一致性哈希：每个节点正在处理的请求数不超过 平均负载*loadFactor（按权重折算），
+// 返回判断节点是否超过上限的函数。loadFactor为0时不限制
+func newLoadBound(peers []*peer, loadFactor float64, skip func(*peer) bool) func(*peer) bool {
+	if loadFactor == 0 {
+		return func(*peer) bool { return false }
+	}
+	var total int64
+	totalWeight := 0
+	for _, p := range peers {
+		if skip != nil && skip(p) {
+			continue
+		}
+		total += p.inflight.Load()
+		totalWeight += p.weight
+	}
+	return func(p *peer) bool {
+		//算上当前请求
+		capacity := math.Ceil(loadFactor * float64(total+1) * float64(p.weight) / float64(totalWeight))
+		return float64(p.inflight.Load()+1) > capacity
 	}
-	return hashRing.nodes[hashRing.ring[idx]]
 }
 
 // 计算crc
@@ -42,18 +94,79 @@ func hash(data []byte) uint32 {
 	return crc32.ChecksumIEEE(data)
 }
 
-// 从后端服务器池中删除字段并重构哈希环
-func (upstream *upstream) del(ip string) {
-	for i, v := range upstream.Addr {
-		//删除切片中的指定元素
-		if ip == v {
-			upstream.Addr = append(upstream.Addr[:i], upstream.Addr[i+1:]...)
-			break
+// 修改后端服务器列表并重构负载均衡器。op返回新的列表，不能修改传入的切片
+func (upstream *upstream) update(op func(lines []string) ([]string, error)) error {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	lines, err := op(upstream.Addr)
+	if err != nil {
+		return err
+	}
+	upstream.Addr = lines
+	upstream.rebuild()
+	return nil
+}
+
+// 后端服务器列表中地址为addr的行，没有时返回-1
+func indexBackend(lines []string, addr string) int {
+	for i, line := range lines {
+		if backendAddr(line) == addr {
+			return i
 		}
 	}
-	upstream.mu.Lock()
-	upstream.hashRing = &hashRing{}
-	upstream.hashRing.nodes = make(map[int]string)
-	upstream.addNode()
-	upstream.mu.Unlock()
+	return -1
+}
+
+// 返回添加一个后端服务器的操作，line可以带属性
+func addBackend(line string) func([]string) ([]string, error) {
+	return func(lines []string) ([]string, error) {
+		b, err := parseBackend(line)
+		if err != nil {
+			return nil, err
+		}
+		if indexBackend(lines, b.addr) >= 0 {
+			return nil, fmt.Errorf("backend %s %w", b.addr, errExists)
+		}
+		return append(lines[:len(lines):len(lines)], strings.Join(strings.Fields(line), " ")), nil
+	}
+}
+
+// 返回删除一个后端服务器的操作
+func removeBackend(addr string) func([]string) ([]string, error) {
+	return func(lines []string) ([]string, error) {
+		i := indexBackend(lines, addr)
+		if i < 0 {
+			return nil, fmt.Errorf("backend %s %w", addr, errNotFound)
+		}
+		return append(lines[:i:i], lines[i+1:]...), nil
+	}
+}
+
+// 返回修改一个后端服务器权重的操作，其他属性不变
+func setBackendWeight(addr string, weight int) func([]string) ([]string, error) {
+	return func(lines []string) ([]string, error) {
+		i := indexBackend(lines, addr)
+		if i < 0 {
+			return nil, fmt.Errorf("backend %s %w", addr, errNotFound)
+		}
+		fields := strings.Fields(lines[i])
+		attr := constant.BACKEND_WEIGHT + "=" + strconv.Itoa(weight)
+		found := false
+		for j, field := range fields[1:] {
+			if key, _, _ := strings.Cut(field, "="); key == constant.BACKEND_WEIGHT {
+				fields[j+1] = attr
+				found = true
+			}
+		}
+		if !found {
+			fields = append(fields, attr)
+		}
+		line := strings.Join(fields, " ")
+		if _, err := parseBackend(line); err != nil {
+			return nil, err
+		}
+		result := append([]string{}, lines...)
+		result[i] = line
+		return result, nil
+	}
 }
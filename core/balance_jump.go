@@ -0,0 +1,59 @@
+package core
+
+//jump consistent hash，不需要查找表，O(ln n)计算。在列表末尾增删后端服务器时只有少量键被重新映射
+
+type jumpHash struct {
+	buckets    []*peer //按权重展开的后端服务器，权重为n的服务器占n个桶
+	peers      []*peer
+	loadFactor float64
+}
+
+func newJumpHash(peers []*peer, upstream *upstream) balancer {
+	j := &jumpHash{peers: peers, loadFactor: upstream.LoadFactor}
+	for _, p := range peers {
+		for w := 0; w < p.weight; w++ {
+			j.buckets = append(j.buckets, p)
+		}
+	}
+	return j
+}
+
+// 节点被跳过或者超过负载上限时对键重新哈希，仍然找不到时按顺序查找
+func (j *jumpHash) pick(key string, skip func(*peer) bool) *peer {
+	if len(j.buckets) == 0 {
+		return nil
+	}
+	overloaded := newLoadBound(j.peers, j.loadFactor, skip)
+	var first *peer
+	h := hash64(key)
+	for attempt := 0; attempt < len(j.buckets); attempt++ {
+		node := j.buckets[jump(h, len(j.buckets))]
+		if skip == nil || !skip(node) {
+			if first == nil {
+				first = node
+			}
+			if !overloaded(node) {
+				return node
+			}
+		}
+		//用线性同余生成下一个哈希值
+		h = h*2862933555777941757 + 1
+	}
+	for _, node := range j.peers {
+		if (skip == nil || !skip(node)) && !overloaded(node) {
+			return node
+		}
+	}
+	return first
+}
+
+// Lamping & Veach, "A Fast, Minimal Memory, Consistent Hash Algorithm"
+func jump(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,89 @@
+package core
+
+//Maglev一致性哈希，查找表O(1)查询，后端服务器变化时只有少量键被重新映射
+
+import (
+	"hash/fnv"
+)
+
+// 查找表大小，必须是质数，远大于后端服务器数量时分布更均匀
+const maglevTableSize = 65537
+
+type maglev struct {
+	table      []*peer //查找表，哈希值取模后直接得到后端服务器
+	peers      []*peer
+	loadFactor float64
+}
+
+// 按权重填充查找表：每一轮中每个后端服务器按自己的排列顺序占据权重个空位
+func newMaglev(peers []*peer, upstream *upstream) balancer {
+	m := &maglev{peers: peers, loadFactor: upstream.LoadFactor}
+	if len(peers) == 0 {
+		return m
+	}
+	m.table = make([]*peer, maglevTableSize)
+	offsets := make([]uint64, len(peers))
+	skips := make([]uint64, len(peers))
+	next := make([]uint64, len(peers))
+	for i, p := range peers {
+		offsets[i] = hash64(p.addr) % maglevTableSize
+		skips[i] = hash64(p.addr+"#skip")%(maglevTableSize-1) + 1
+	}
+	filled := 0
+	for filled < maglevTableSize {
+		for i, p := range peers {
+			for w := 0; w < p.weight && filled < maglevTableSize; w++ {
+				//找到排列中下一个空位
+				for {
+					slot := (offsets[i] + next[i]*skips[i]) % maglevTableSize
+					next[i]++
+					if m.table[slot] == nil {
+						m.table[slot] = p
+						filled++
+						break
+					}
+				}
+			}
+		}
+	}
+	return m
+}
+
+// 节点被跳过或者超过负载上限时沿查找表向后找
+func (m *maglev) pick(key string, skip func(*peer) bool) *peer {
+	if len(m.table) == 0 {
+		return nil
+	}
+	idx := hash64(key) % maglevTableSize
+	overloaded := newLoadBound(m.peers, m.loadFactor, skip)
+	if node := m.table[idx]; (skip == nil || !skip(node)) && !overloaded(node) {
+		return node
+	}
+	var first *peer
+	//每个后端服务器在表中至少有一个位置，但可能相距很远，表遍历完之前检查一遍所有节点即可
+	tried := make(map[*peer]bool, len(m.peers))
+	for i := uint64(0); i < maglevTableSize && len(tried) < len(m.peers); i++ {
+		node := m.table[(idx+i)%maglevTableSize]
+		if tried[node] {
+			continue
+		}
+		tried[node] = true
+		if skip != nil && skip(node) {
+			continue
+		}
+		if first == nil {
+			first = node
+		}
+		if !overloaded(node) {
+			return node
+		}
+	}
+	return first
+}
+
+// 64位fnv-1a哈希
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
@@ -0,0 +1,110 @@
+package core
+
+//比较各个哈希策略的分布
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"text/tabwriter"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 参与分布报告的哈希策略
+var hashPolicies = []string{constant.POLICY_IP_HASH, constant.POLICY_MAGLEV, constant.POLICY_JUMP_HASH}
+
+// DistributionReport 用keys个模拟的哈希键，比较各个哈希策略在后端服务器池上的分布，
+// 以及摘除第一个后端服务器时被重新映射的键的比例。name为空时报告所有后端服务器池
+func DistributionReport(fileName, name string, keys int) (string, error) {
+	cfg, err := loadConfig(fileName)
+	if err != nil {
+		return "", err
+	}
+	if keys <= 0 {
+		return "", fmt.Errorf("keys must be positive, got %d", keys)
+	}
+	var b bytes.Buffer
+	found := false
+	for _, upstreamName := range sortedKeys(cfg.Upstream) {
+		if name != "" && upstreamName != name {
+			continue
+		}
+		found = true
+		distributionReport(&b, upstreamName, cfg.Upstream[upstreamName], keys)
+	}
+	if !found {
+		return "", fmt.Errorf("upstream %q is not defined", name)
+	}
+	return b.String(), nil
+}
+
+func distributionReport(b *bytes.Buffer, name string, upstream *upstream, keys int) {
+	//只统计主服务器
+	var peers []*peer
+	totalWeight := 0
+	for _, line := range upstream.Addr {
+		backend, err := parseBackend(line)
+		if err != nil || backend.backup {
+			continue
+		}
+		peers = append(peers, &peer{backend: backend})
+		totalWeight += backend.weight
+	}
+	fmt.Fprintf(b, "upstream %s: %d backends, %d keys, replicas=%d\n", name, len(peers), keys, upstream.Replicas)
+	if len(peers) == 0 {
+		return
+	}
+	keyAt := func(i int) string {
+		return fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255)
+	}
+	counts := make(map[string]map[*peer]int)
+	moved := make(map[string]int)
+	for _, policy := range hashPolicies {
+		counts[policy] = make(map[*peer]int)
+		all := balancers[policy](peers, upstream)
+		rest := balancers[policy](peers[1:], upstream)
+		for i := 0; i < keys; i++ {
+			key := keyAt(i)
+			p := all.pick(key, nil)
+			counts[policy][p]++
+			if len(peers) > 1 && p != peers[0] && rest.pick(key, nil) != p {
+				moved[policy]++
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+	fmt.Fprint(w, "backend\tweight\texpected")
+	for _, policy := range hashPolicies {
+		fmt.Fprintf(w, "\t%s", policy)
+	}
+	fmt.Fprintln(w)
+	deviation := make(map[string]float64)
+	for _, p := range peers {
+		expected := float64(p.weight) / float64(totalWeight)
+		fmt.Fprintf(w, "%s\t%d\t%.2f%%", p.addr, p.weight, expected*100)
+		for _, policy := range hashPolicies {
+			share := float64(counts[policy][p]) / float64(keys)
+			deviation[policy] = math.Max(deviation[policy], math.Abs(share-expected)/expected)
+			fmt.Fprintf(w, "\t%.2f%%", share*100)
+		}
+		fmt.Fprintln(w)
+	}
+	//理想情况下最大偏差为0
+	fmt.Fprint(w, "max deviation\t\t")
+	for _, policy := range hashPolicies {
+		fmt.Fprintf(w, "\t%.2f%%", deviation[policy]*100)
+	}
+	fmt.Fprintln(w)
+	//理想情况下只有被摘除的服务器上的键需要重新映射，其他键不动
+	if len(peers) > 1 {
+		fmt.Fprintf(w, "moved without %s\t\t", peers[0].addr)
+		for _, policy := range hashPolicies {
+			fmt.Fprintf(w, "\t%.2f%%", float64(moved[policy])/float64(keys)*100)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	fmt.Fprintln(b)
+}
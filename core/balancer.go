@@ -0,0 +1,305 @@
+package core
+
+//可插拔的负载均衡策略
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 后端服务器的运行时状态
+type peer struct {
+	backend
+	inflight  atomic.Int64 //正在处理的请求数
+	unhealthy atomic.Bool  //主动健康检查失败
+	rise      int          //健康检查连续成功次数，只在健康检查协程中访问
+	fall      int          //健康检查连续失败次数，只在健康检查协程中访问
+	mu        sync.Mutex
+	failures  []time.Time  //fail_timeout内的请求失败时间
+	failing   atomic.Bool  //failures不为空
+	downUntil atomic.Int64 //请求失败过多，暂停使用到这个时间（UnixNano）
+	breaker   *breaker     //熔断器，没有配置时为nil
+	warmFrom  atomic.Int64 //慢启动开始的时间（UnixNano），为0时不在慢启动中
+	stats     ewmaStats    //响应时间和错误率
+	ejected   atomic.Int64 //被异常检测摘除到这个时间（UnixNano）
+	draining  atomic.Bool  //通过管理接口摘除，不再接收新的请求，正在处理的请求不受影响
+}
+
+// 是否可以接收请求
+func (p *peer) available() bool {
+	now := time.Now().UnixNano()
+	return !p.unhealthy.Load() && !p.draining.Load() && now >= p.downUntil.Load() && now >= p.ejected.Load() && p.breaker.ready()
+}
+
+// 负载均衡策略
+type balancer interface {
+	// 为请求挑选后端服务器。key为哈希键，只有哈希类策略使用；skip返回true的后端服务器不参与选择。
+	// 没有可用的后端服务器时返回nil
+	pick(key string, skip func(*peer) bool) *peer
+}
+
+// 根据后端服务器列表和后端服务器池的配置构建负载均衡器
+type balancerFactory func(peers []*peer, upstream *upstream) balancer
+
+// 所有策略，通过upstream的policy字段选择
+var balancers = map[string]balancerFactory{
+	constant.POLICY_IP_HASH:              newHashRing,
+	constant.POLICY_MAGLEV:               newMaglev,
+	constant.POLICY_JUMP_HASH:            newJumpHash,
+	constant.POLICY_ROUND_ROBIN:          newRoundRobin,
+	constant.POLICY_WEIGHTED_ROUND_ROBIN: newWeightedRoundRobin,
+	constant.POLICY_LEAST_CONN:           newLeastConn,
+	constant.POLICY_RANDOM:               newRandom,
+	constant.POLICY_P2C:                  newPowerOfTwoChoices,
+	constant.POLICY_PEAK_EWMA:            newPeakEWMA,
+}
+
+// 负载均衡器的快照，后端服务器变化时整体替换，请求处理中不需要加锁
+type balancerState struct {
+	peers    []*peer
+	balancer balancer         //主服务器
+	backup   balancer         //备用服务器，没有时为nil
+	sticky   map[string]*peer //会话保持cookie中的标识到后端服务器，没有配置时为nil
+}
+
+// 按当前的后端服务器列表重建负载均衡器，调用方需持有upstream.mu
+func (upstream *upstream) rebuild() {
+	old := make(map[string]*peer)
+	if state := upstream.state.Load(); state != nil {
+		for _, p := range state.peers {
+			old[p.addr] = p
+		}
+	}
+	members := upstream.members()
+	peers := make([]*peer, 0, len(members))
+	var primary, backup []*peer
+	for _, line := range members {
+		b, err := parseBackend(line)
+		if err != nil {
+			logger.Error("后端服务器池", upstream.name, "配置错误:", err)
+			continue
+		}
+		//属性没变时沿用原来的对象，保留运行时状态
+		p, ok := old[b.addr]
+		if !ok || p.backend != b {
+			prev := p
+			p = &peer{backend: b, breaker: newBreaker(upstream.breaker, upstream.name, b.addr)}
+			switch {
+			case ok:
+				//只修改了属性（例如权重），保留摘除状态
+				p.draining.Store(prev.draining.Load())
+			case len(old) > 0:
+				//运行中新加入的后端服务器需要慢启动，首次构建时不需要
+				p.warmUp(time.Now())
+			}
+		}
+		peers = append(peers, p)
+		if b.backup {
+			backup = append(backup, p)
+		} else {
+			primary = append(primary, p)
+		}
+	}
+	policy := upstream.Policy
+	if policy == "" {
+		policy = constant.POLICY_IP_HASH
+	}
+	state := &balancerState{peers: peers, balancer: balancers[policy](primary, upstream), sticky: upstream.sticky.index(peers)}
+	if len(backup) > 0 {
+		state.backup = balancers[policy](backup, upstream)
+	}
+	upstream.state.Store(state)
+}
+
+// 为请求挑选后端服务器，不可用的后端服务器不参与选择
+func (upstream *upstream) pick(key string, skip func(*peer) bool) *peer {
+	state := upstream.state.Load()
+	if state == nil {
+		return nil
+	}
+	unavailable := func(p *peer) bool {
+		return !p.available() || skip != nil && skip(p)
+	}
+	//慢启动中的后端服务器按比例跳过，跳过之后没有可选的后端服务器时不再跳过
+	if warming := upstream.warming(state.peers); warming != nil {
+		if p := state.pick(key, func(p *peer) bool { return warming[p] || unavailable(p) }); p != nil {
+			return p
+		}
+	}
+	return state.pick(key, unavailable)
+}
+
+// 先从主服务器中选择，都不可用时从备用服务器中选择
+func (state *balancerState) pick(key string, skip func(*peer) bool) *peer {
+	if p := state.balancer.pick(key, skip); p != nil || state.backup == nil {
+		return p
+	}
+	return state.backup.pick(key, skip)
+}
+
+// 是否还有可以选择的后端服务器。不调用负载均衡器，不影响轮询等策略的状态
+func (upstream *upstream) hasCandidate(skip func(*peer) bool) bool {
+	state := upstream.state.Load()
+	if state == nil {
+		return false
+	}
+	for _, p := range state.peers {
+		if p.available() && (skip == nil || !skip(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 从候选中过滤掉被跳过的后端服务器
+func candidates(peers []*peer, skip func(*peer) bool) []*peer {
+	if skip == nil {
+		return peers
+	}
+	var result []*peer
+	for _, p := range peers {
+		if !skip(p) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// 轮询
+type roundRobin struct {
+	peers []*peer
+	next  atomic.Uint64
+}
+
+func newRoundRobin(peers []*peer, _ *upstream) balancer {
+	return &roundRobin{peers: peers}
+}
+
+func (rr *roundRobin) pick(_ string, skip func(*peer) bool) *peer {
+	n := uint64(len(rr.peers))
+	start := rr.next.Add(1) - 1
+	for i := uint64(0); i < n; i++ {
+		p := rr.peers[(start+i)%n]
+		if skip == nil || !skip(p) {
+			return p
+		}
+	}
+	return nil
+}
+
+// 平滑加权轮询，与nginx的算法一致
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	peers   []*peer
+	current []int
+}
+
+func newWeightedRoundRobin(peers []*peer, _ *upstream) balancer {
+	return &weightedRoundRobin{peers: peers, current: make([]int, len(peers))}
+}
+
+func (wrr *weightedRoundRobin) pick(_ string, skip func(*peer) bool) *peer {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+	best := -1
+	total := 0
+	for i, p := range wrr.peers {
+		if skip != nil && skip(p) {
+			continue
+		}
+		wrr.current[i] += p.weight
+		total += p.weight
+		if best < 0 || wrr.current[i] > wrr.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	wrr.current[best] -= total
+	return wrr.peers[best]
+}
+
+// 最少连接，负载相同时轮流选择
+type leastConn struct {
+	peers []*peer
+	next  atomic.Uint64
+}
+
+func newLeastConn(peers []*peer, _ *upstream) balancer {
+	return &leastConn{peers: peers}
+}
+
+func (lc *leastConn) pick(_ string, skip func(*peer) bool) *peer {
+	peers := candidates(lc.peers, skip)
+	if len(peers) == 0 {
+		return nil
+	}
+	start := int(lc.next.Add(1) % uint64(len(peers)))
+	best := peers[start]
+	for i := 1; i < len(peers); i++ {
+		if p := peers[(start+i)%len(peers)]; less(p, best) {
+			best = p
+		}
+	}
+	return best
+}
+
+// 按正在处理的请求数/权重比较负载，a比b空闲时返回true
+func less(a, b *peer) bool {
+	return (a.inflight.Load()+1)*int64(b.weight) < (b.inflight.Load()+1)*int64(a.weight)
+}
+
+// 按权重随机
+type random struct {
+	peers []*peer
+}
+
+func newRandom(peers []*peer, _ *upstream) balancer {
+	return &random{peers: peers}
+}
+
+func (r *random) pick(_ string, skip func(*peer) bool) *peer {
+	return weightedRandom(candidates(r.peers, skip))
+}
+
+func weightedRandom(peers []*peer) *peer {
+	total := 0
+	for _, p := range peers {
+		total += p.weight
+	}
+	if total <= 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for _, p := range peers {
+		if n < p.weight {
+			return p
+		}
+		n -= p.weight
+	}
+	return nil
+}
+
+// 随机选两个，取负载较低的一个
+type powerOfTwoChoices struct {
+	peers []*peer
+}
+
+func newPowerOfTwoChoices(peers []*peer, _ *upstream) balancer {
+	return &powerOfTwoChoices{peers: peers}
+}
+
+func (p2c *powerOfTwoChoices) pick(_ string, skip func(*peer) bool) *peer {
+	peers := candidates(p2c.peers, skip)
+	a := weightedRandom(peers)
+	b := weightedRandom(peers)
+	if a == nil || b == nil || less(a, b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,449 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+func testUpstream(policy string, addrs ...string) *upstream {
+	u := &upstream{Addr: addrs, Replicas: 10, Policy: policy}
+	u.prepare()
+	return u
+}
+
+// 统计每个后端服务器被选中的次数
+func distribution(u *upstream, n int, skip func(*peer) bool) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		p := u.pick(fmt.Sprintf("10.0.0.%d", i), skip)
+		if p != nil {
+			counts[p.addr]++
+		}
+	}
+	return counts
+}
+
+func TestBalancers(t *testing.T) {
+	addrs := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	for policy := range balancers {
+		u := testUpstream(policy, addrs...)
+		counts := distribution(u, 3000, nil)
+		for _, addr := range addrs {
+			if counts[addr] == 0 {
+				t.Errorf("%s: backend %s never picked: %v", policy, addr, counts)
+			}
+		}
+		//被跳过的后端服务器不会被选中
+		counts = distribution(u, 300, func(p *peer) bool { return p.addr == addrs[0] })
+		if counts[addrs[0]] != 0 || counts[addrs[1]]+counts[addrs[2]] != 300 {
+			t.Errorf("%s: skipped backend picked: %v", policy, counts)
+		}
+		if p := u.pick("x", func(*peer) bool { return true }); p != nil {
+			t.Errorf("%s: expected nil when every backend is skipped", policy)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	u := testUpstream(constant.POLICY_ROUND_ROBIN, "127.0.0.1:1", "127.0.0.1:2")
+	counts := distribution(u, 100, nil)
+	if counts["127.0.0.1:1"] != 50 || counts["127.0.0.1:2"] != 50 {
+		t.Fatalf("unexpected distribution: %v", counts)
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	u := testUpstream(constant.POLICY_LEAST_CONN, "127.0.0.1:1", "127.0.0.1:2")
+	busy := u.pick("", nil)
+	busy.inflight.Add(5)
+	for i := 0; i < 10; i++ {
+		if p := u.pick("", nil); p == busy {
+			t.Fatal("busy backend picked")
+		}
+	}
+}
+
+func TestIpHashAffinity(t *testing.T) {
+	u := testUpstream(constant.POLICY_IP_HASH, "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	first := u.pick("192.168.1.1", nil)
+	for i := 0; i < 10; i++ {
+		if p := u.pick("192.168.1.1", nil); p != first {
+			t.Fatal("ip_hash should keep affinity")
+		}
+	}
+	empty := testUpstream(constant.POLICY_IP_HASH)
+	if empty.pick("192.168.1.1", nil) != nil {
+		t.Fatal("expected nil for empty upstream")
+	}
+}
+
+func TestWeightedBackends(t *testing.T) {
+	u := testUpstream(constant.POLICY_WEIGHTED_ROUND_ROBIN, "127.0.0.1:1 weight=5", "127.0.0.1:2")
+	counts := distribution(u, 60, nil)
+	if counts["127.0.0.1:1"] != 50 || counts["127.0.0.1:2"] != 10 {
+		t.Fatalf("unexpected distribution: %v", counts)
+	}
+	//哈希环上的虚拟节点数与权重成正比
+	u = testUpstream(constant.POLICY_IP_HASH, "127.0.0.1:1 weight=4", "127.0.0.1:2")
+	counts = distribution(u, 5000, nil)
+	if counts["127.0.0.1:1"] < 2*counts["127.0.0.1:2"] {
+		t.Fatalf("weight not respected by hash ring: %v", counts)
+	}
+}
+
+func TestBackupBackends(t *testing.T) {
+	u := testUpstream(constant.POLICY_ROUND_ROBIN, "127.0.0.1:1", "127.0.0.1:2 backup")
+	counts := distribution(u, 10, nil)
+	if counts["127.0.0.1:2"] != 0 {
+		t.Fatalf("backup used while primary is available: %v", counts)
+	}
+	if err := u.update(removeBackend("127.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	if p := u.pick("", nil); p == nil || p.addr != "127.0.0.1:2" {
+		t.Fatalf("expected backup, got %v", p)
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/a/b?id=7", nil)
+	r.Header.Set("X-Tenant", "acme")
+	r.AddCookie(&http.Cookie{Name: "user", Value: "bob"})
+	for template, want := range map[string]string{
+		"":                        "10.0.0.1",
+		"$cookie_user":            "bob",
+		"$http_x_tenant:$uri":     "acme:/a/b",
+		"$arg_id-$host":           "7-example.com",
+		"$request_uri":            "/a/b?id=7",
+		"$cookie_missing":         "10.0.0.1",
+		"tenant-$http_x_missing":  "10.0.0.1",
+		"$remote_addr/$arg_other": "10.0.0.1/",
+	} {
+		key, err := parseHashKey(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := key.eval(r, "10.0.0.1"); got != want {
+			t.Errorf("%q: got %q, want %q", template, got, want)
+		}
+	}
+	for _, template := range []string{"$", "$foo", "$http_"} {
+		if _, err := parseHashKey(template); err == nil {
+			t.Errorf("%q: expected error", template)
+		}
+	}
+}
+
+func TestBoundedLoadHashing(t *testing.T) {
+	addrs := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	u := testUpstream(constant.POLICY_IP_HASH, addrs...)
+	u.LoadFactor = 1.25
+	u.prepare()
+	//同一个热点键的请求都未结束时，超过上限的节点被跳过
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		p := u.pick("hot", nil)
+		p.inflight.Add(1)
+		counts[p.addr]++
+	}
+	for _, addr := range addrs {
+		if counts[addr] > 13 {
+			t.Fatalf("load bound exceeded: %v", counts)
+		}
+	}
+	//负载降下来后回到原来的节点
+	home := testUpstream(constant.POLICY_IP_HASH, addrs...).pick("hot", nil).addr
+	for _, p := range u.state.Load().peers {
+		p.inflight.Store(0)
+	}
+	if p := u.pick("hot", nil); p.addr != home {
+		t.Fatalf("affinity lost: got %s, want %s", p.addr, home)
+	}
+}
+
+func TestLookupTableHashing(t *testing.T) {
+	addrs := []string{"127.0.0.1:1 weight=2", "127.0.0.1:2", "127.0.0.1:3", "127.0.0.1:4"}
+	for _, policy := range []string{constant.POLICY_MAGLEV, constant.POLICY_JUMP_HASH} {
+		u := testUpstream(policy, addrs...)
+		counts := distribution(u, 10000, nil)
+		if share := float64(counts["127.0.0.1:1"]) / 10000; share < 0.37 || share > 0.43 {
+			t.Errorf("%s: weight not respected: %v", policy, counts)
+		}
+	}
+	//Maglev摘除一个后端服务器时，其他服务器上的键基本不动
+	all := testUpstream(constant.POLICY_MAGLEV, addrs...)
+	rest := testUpstream(constant.POLICY_MAGLEV, addrs[1:]...)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprint(i)
+		if p := all.pick(key, nil); p.addr != "127.0.0.1:1" && rest.pick(key, nil).addr != p.addr {
+			moved++
+		}
+	}
+	if moved > 200 {
+		t.Fatalf("maglev moved %d keys", moved)
+	}
+	report, err := DistributionReport("../configs/config.cfg.example", "pool1", 1000)
+	if err != nil || !strings.Contains(report, constant.POLICY_MAGLEV) {
+		t.Fatalf("unexpected report %q: %v", report, err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	consecutive := 3
+	settings, err := (&circuitBreaker{
+		ConsecutiveFailures: &consecutive,
+		MinRequests:         4,
+		ErrorRate:           0.5,
+		OpenTimeout:         duration(50 * time.Millisecond),
+		HalfOpenRequests:    2,
+	}).compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBreaker(settings, "pool1", "127.0.0.1:1")
+	//连续失败
+	for i := 0; i < 3; i++ {
+		b.record(false)
+	}
+	if b.ready() || b.acquire() {
+		t.Fatal("breaker should be open after consecutive failures")
+	}
+	//到期后进入半开状态，只放行两个探测请求
+	time.Sleep(60 * time.Millisecond)
+	if !b.acquire() || !b.acquire() || b.acquire() {
+		t.Fatal("half-open breaker should allow exactly two probes")
+	}
+	b.record(true)
+	b.record(false)
+	if b.ready() {
+		t.Fatal("failed probe should reopen the breaker")
+	}
+	time.Sleep(60 * time.Millisecond)
+	b.acquire()
+	b.acquire()
+	b.record(true)
+	b.record(true)
+	if b.state != breakerClosed {
+		t.Fatalf("breaker should be closed, got %s", breakerStates[b.state])
+	}
+	//按错误率熔断
+	b.record(true)
+	b.record(false)
+	b.record(true)
+	if !b.ready() {
+		t.Fatal("breaker opened below min_requests")
+	}
+	b.record(false)
+	if b.ready() {
+		t.Fatal("breaker should be open at 50% error rate")
+	}
+	//窗口太小时桶的时长为0，会除零
+	if _, err := (&circuitBreaker{Window: duration(5 * time.Nanosecond)}).compile(); err == nil {
+		t.Fatal("tiny window should be rejected")
+	}
+	//熔断的后端服务器不参与选择
+	u := testUpstream(constant.POLICY_ROUND_ROBIN, "127.0.0.1:1", "127.0.0.1:2")
+	u.state.Load().peers[0].breaker = b
+	if counts := distribution(u, 10, nil); counts["127.0.0.1:1"] != 0 {
+		t.Fatalf("open breaker picked: %v", counts)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	u := &upstream{Addr: []string{"127.0.0.1:1", "127.0.0.1:2"}, Policy: constant.POLICY_ROUND_ROBIN, SlowStart: duration(time.Second)}
+	u.prepare()
+	//首次构建时不需要慢启动
+	for _, p := range u.state.Load().peers {
+		if p.warmFrom.Load() != 0 {
+			t.Fatalf("backend %s warming after the initial build", p.addr)
+		}
+	}
+	//慢启动进行到1/4，流量约为完整份额（50%）的1/4
+	u.state.Load().peers[1].warmUp(time.Now().Add(-250 * time.Millisecond))
+	counts := distribution(u, 4000, nil)
+	if n := counts["127.0.0.1:2"]; n < 300 || n > 800 {
+		t.Fatalf("unexpected distribution while warming: %v", counts)
+	}
+	//暂停还没结束时不接收流量，但是只剩它时仍然可以选中
+	u.state.Load().peers[1].warmUp(time.Now().Add(time.Minute))
+	if counts := distribution(u, 100, nil); counts["127.0.0.1:2"] != 0 {
+		t.Fatalf("backend picked before slow start began: %v", counts)
+	}
+	if p := u.pick("", func(p *peer) bool { return p.addr == "127.0.0.1:1" }); p == nil {
+		t.Fatal("expected the warming backend when it is the only candidate")
+	}
+	//运行中新加入的后端服务器需要慢启动
+	u.mu.Lock()
+	u.Addr = append(u.Addr, "127.0.0.1:3")
+	u.rebuild()
+	u.mu.Unlock()
+	peers := u.state.Load().peers
+	if peers[0].warmFrom.Load() != 0 || peers[2].warmFrom.Load() == 0 {
+		t.Fatal("expected only the added backend to be warming")
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	u := testUpstream(constant.POLICY_PEAK_EWMA, "127.0.0.1:1", "127.0.0.1:2")
+	peers := u.state.Load().peers
+	peers[0].stats.observe(100*time.Millisecond, false)
+	peers[1].stats.observe(time.Millisecond, false)
+	//随机选两个时，只要选中了快的就用快的，约75%
+	counts := distribution(u, 1000, nil)
+	if counts["127.0.0.1:2"] < 650 {
+		t.Fatalf("expected the faster backend to be preferred: %v", counts)
+	}
+	//失败的请求不会拉低响应时间
+	peers[0].stats.observe(0, true)
+	if latency, errorRate, _ := peers[0].stats.load(time.Now()); latency < float64(90*time.Millisecond) || errorRate == 0 {
+		t.Fatalf("unexpected stats after a failure: latency %v, error rate %v", time.Duration(latency), errorRate)
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	for _, od := range []*outlierDetection{{Interval: duration(-time.Second)}, {EjectionTime: duration(-time.Second)}} {
+		if _, err := od.compile(); err == nil {
+			t.Fatalf("negative duration should be rejected: %+v", od)
+		}
+	}
+	settings, err := (&outlierDetection{}).compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := testUpstream(constant.POLICY_ROUND_ROBIN, "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3", "127.0.0.1:4")
+	peers := u.state.Load().peers
+	for i := 0; i < 20; i++ {
+		peers[0].stats.observe(200*time.Millisecond, false)
+		peers[1].stats.observe(10*time.Millisecond, false)
+		peers[2].stats.observe(12*time.Millisecond, false)
+		peers[3].stats.observe(10*time.Millisecond, i%10 == 0)
+	}
+	u.detectOutliers(settings, time.Now())
+	if peers[0].available() {
+		t.Fatal("expected the slow backend to be ejected")
+	}
+	for _, p := range peers[1:] {
+		if !p.available() {
+			t.Fatalf("backend %s ejected unexpectedly", p.addr)
+		}
+	}
+
+	//错误率过高的摘除，同时被摘除的不超过max_ejection_percent
+	u = testUpstream(constant.POLICY_ROUND_ROBIN, "127.0.0.1:1", "127.0.0.1:2")
+	peers = u.state.Load().peers
+	for i := 0; i < 20; i++ {
+		peers[0].stats.observe(time.Millisecond, true)
+		peers[1].stats.observe(time.Millisecond, true)
+	}
+	u.detectOutliers(settings, time.Now())
+	if peers[0].available() == peers[1].available() {
+		t.Fatal("expected exactly one backend to be ejected")
+	}
+	//请求数不够时不参与检测
+	u.detectOutliers(settings, time.Now())
+	if !peers[0].available() && !peers[1].available() {
+		t.Fatal("backend ejected without enough requests")
+	}
+}
+
+// 测试用的DNS解析，返回固定的记录
+type stubResolver struct {
+	ips  []string
+	srvs []*net.SRV
+}
+
+func (r *stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if len(r.ips) == 0 {
+		return nil, fmt.Errorf("lookup %s: no such host", host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range r.ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *stubResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	return name, r.srvs, nil
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	if _, err := (&discovery{DNS: "svc.local:8080", Interval: duration(-time.Second)}).compile(); err == nil {
+		t.Fatal("negative discovery interval should be rejected")
+	}
+	stub := &stubResolver{ips: []string{"10.0.0.2", "10.0.0.1", "fd00::1"}}
+	old := defaultResolver
+	defaultResolver = stub
+	defer func() { defaultResolver = old }()
+	addrs := func(u *upstream) []string {
+		var result []string
+		for _, p := range u.state.Load().peers {
+			result = append(result, p.addr)
+			if p.backup {
+				result[len(result)-1] += " backup"
+			}
+		}
+		return result
+	}
+
+	u := &upstream{Addr: []string{"127.0.0.1:1"}, Replicas: 1, Policy: constant.POLICY_ROUND_ROBIN,
+		Discovery: &discovery{DNS: "svc.local:8080", DNSType: constant.DNS_TYPE_A, Attributes: "max_fails=1"}}
+	u.prepare()
+	if got := fmt.Sprint(addrs(u)); got != "[127.0.0.1:1 10.0.0.1:8080 10.0.0.2:8080]" {
+		t.Fatalf("unexpected members: %s", got)
+	}
+	kept := u.state.Load().peers[1]
+	if kept.maxFails != 1 {
+		t.Fatalf("discovery attributes not applied: %+v", kept.backend)
+	}
+	//记录变化时只替换变化的后端服务器，解析失败时保留原来的
+	stub.ips = []string{"10.0.0.1", "10.0.0.3"}
+	u.refresh(context.Background(), u.discoverer)
+	if got := fmt.Sprint(addrs(u)); got != "[127.0.0.1:1 10.0.0.1:8080 10.0.0.3:8080]" || u.state.Load().peers[1] != kept {
+		t.Fatalf("unexpected members after update: %s", got)
+	}
+	stub.ips = nil
+	u.refresh(context.Background(), u.discoverer)
+	if got := fmt.Sprint(addrs(u)); got != "[127.0.0.1:1 10.0.0.1:8080 10.0.0.3:8080]" {
+		t.Fatalf("members changed after a failed lookup: %s", got)
+	}
+
+	//SRV记录：优先级最高的为主服务器，其余为备用服务器
+	stub.srvs = []*net.SRV{
+		{Target: "b.svc.local.", Port: 81, Priority: 20, Weight: 1},
+		{Target: "a.svc.local.", Port: 80, Priority: 10, Weight: 5},
+	}
+	u = &upstream{Replicas: 1, Policy: constant.POLICY_ROUND_ROBIN, Discovery: &discovery{DNS: "_http._tcp.svc.local", DNSType: constant.DNS_TYPE_SRV}}
+	u.prepare()
+	if got := fmt.Sprint(addrs(u)); got != "[a.svc.local:80 b.svc.local:81 backup]" || u.state.Load().peers[0].weight != 5 {
+		t.Fatalf("unexpected members from srv records: %s", got)
+	}
+
+	//文件：每行一个或者JSON数组，内容无效时保留原来的
+	file := writeTestConfig(t, "backends.txt", "# backends\n127.0.0.1:2 weight=3\n\n127.0.0.1:3\n")
+	u = &upstream{Replicas: 1, Policy: constant.POLICY_ROUND_ROBIN, Discovery: &discovery{File: file}}
+	u.prepare()
+	if got := fmt.Sprint(addrs(u)); got != "[127.0.0.1:2 127.0.0.1:3]" {
+		t.Fatalf("unexpected members from file: %s", got)
+	}
+	os.WriteFile(file, []byte(`["127.0.0.1:3", "127.0.0.1:4 backup"]`), 0644)
+	u.refresh(context.Background(), u.discoverer)
+	if got := fmt.Sprint(addrs(u)); got != "[127.0.0.1:3 127.0.0.1:4 backup]" {
+		t.Fatalf("unexpected members after file update: %s", got)
+	}
+	os.WriteFile(file, []byte("127.0.0.1:5 weight=0\n"), 0644)
+	u.refresh(context.Background(), u.discoverer)
+	if got := fmt.Sprint(addrs(u)); got != "[127.0.0.1:3 127.0.0.1:4 backup]" {
+		t.Fatalf("members changed after an invalid file: %s", got)
+	}
+}
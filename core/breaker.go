@@ -0,0 +1,288 @@
+package core
+
+//每个后端服务器的熔断器：关闭（正常）-> 打开（不接收请求）-> 半开（放行少量探测请求）-> 关闭
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 熔断器配置
+type circuitBreaker struct {
+	Window              duration `json:"window,omitempty"`               //统计错误率的滑动窗口，默认10s
+	ErrorRate           float64  `json:"error_rate,omitempty"`           //窗口内错误率达到多少时熔断，默认0.5
+	MinRequests         int      `json:"min_requests,omitempty"`         //窗口内请求数达到多少才按错误率熔断，默认20
+	ConsecutiveFailures *int     `json:"consecutive_failures,omitempty"` //连续失败多少次时熔断，默认5，0表示不按连续失败熔断
+	OpenTimeout         duration `json:"open_timeout,omitempty"`         //熔断多久之后进入半开状态，默认30s
+	HalfOpenRequests    int      `json:"half_open_requests,omitempty"`   //半开状态放行的探测请求数，默认1
+}
+
+// 设置熔断器的配置项
+func (cb *circuitBreaker) setOption(key, value string) error {
+	switch key {
+	case constant.CIRCUIT_BREAKER_WINDOW, constant.CIRCUIT_BREAKER_OPEN_TIMEOUT:
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		if key == constant.CIRCUIT_BREAKER_WINDOW {
+			cb.Window = d
+		} else {
+			cb.OpenTimeout = d
+		}
+	case constant.CIRCUIT_BREAKER_ERROR_RATE:
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s 字段设置错误：%q is not a number", key, value)
+		}
+		cb.ErrorRate = rate
+	case constant.CIRCUIT_BREAKER_MIN_REQUESTS, constant.CIRCUIT_BREAKER_CONSECUTIVE_FAILURES, constant.CIRCUIT_BREAKER_HALF_OPEN_REQUESTS:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s 字段设置错误：%q is not a number", key, value)
+		}
+		switch key {
+		case constant.CIRCUIT_BREAKER_MIN_REQUESTS:
+			cb.MinRequests = n
+		case constant.CIRCUIT_BREAKER_CONSECUTIVE_FAILURES:
+			cb.ConsecutiveFailures = &n
+		default:
+			cb.HalfOpenRequests = n
+		}
+	default:
+		return fmt.Errorf("unknown key %q in upstream", key)
+	}
+	return nil
+}
+
+// 已设置的配置项，用于输出[server]风格的配置
+func (cb *circuitBreaker) options() [][2]string {
+	var options [][2]string
+	if cb.Window != 0 {
+		options = append(options, [2]string{constant.CIRCUIT_BREAKER_WINDOW, cb.Window.String()})
+	}
+	if cb.ErrorRate != 0 {
+		options = append(options, [2]string{constant.CIRCUIT_BREAKER_ERROR_RATE, strconv.FormatFloat(cb.ErrorRate, 'g', -1, 64)})
+	}
+	if cb.MinRequests != 0 {
+		options = append(options, [2]string{constant.CIRCUIT_BREAKER_MIN_REQUESTS, strconv.Itoa(cb.MinRequests)})
+	}
+	if cb.ConsecutiveFailures != nil {
+		options = append(options, [2]string{constant.CIRCUIT_BREAKER_CONSECUTIVE_FAILURES, strconv.Itoa(*cb.ConsecutiveFailures)})
+	}
+	if cb.OpenTimeout != 0 {
+		options = append(options, [2]string{constant.CIRCUIT_BREAKER_OPEN_TIMEOUT, cb.OpenTimeout.String()})
+	}
+	if cb.HalfOpenRequests != 0 {
+		options = append(options, [2]string{constant.CIRCUIT_BREAKER_HALF_OPEN_REQUESTS, strconv.Itoa(cb.HalfOpenRequests)})
+	}
+	return options
+}
+
+// 补全默认值并校验后的熔断器配置
+type breakerSettings struct {
+	window              time.Duration
+	errorRate           float64
+	minRequests         int
+	consecutiveFailures int
+	openTimeout         time.Duration
+	halfOpenRequests    int
+}
+
+func (cb *circuitBreaker) compile() (*breakerSettings, error) {
+	settings := &breakerSettings{
+		window:              time.Duration(cb.Window),
+		errorRate:           cb.ErrorRate,
+		minRequests:         cb.MinRequests,
+		consecutiveFailures: constant.DEFAULT_CIRCUIT_BREAKER_CONSECUTIVE_FAILURES,
+		openTimeout:         time.Duration(cb.OpenTimeout),
+		halfOpenRequests:    cb.HalfOpenRequests,
+	}
+	if settings.window == 0 {
+		settings.window = constant.DEFAULT_CIRCUIT_BREAKER_WINDOW
+	}
+	if settings.errorRate == 0 {
+		settings.errorRate = constant.DEFAULT_CIRCUIT_BREAKER_ERROR_RATE
+	}
+	if settings.minRequests == 0 {
+		settings.minRequests = constant.DEFAULT_CIRCUIT_BREAKER_MIN_REQUESTS
+	}
+	if cb.ConsecutiveFailures != nil {
+		settings.consecutiveFailures = *cb.ConsecutiveFailures
+	}
+	if settings.openTimeout == 0 {
+		settings.openTimeout = constant.DEFAULT_CIRCUIT_BREAKER_OPEN_TIMEOUT
+	}
+	if settings.halfOpenRequests == 0 {
+		settings.halfOpenRequests = constant.DEFAULT_CIRCUIT_BREAKER_HALF_OPEN_REQUESTS
+	}
+	switch {
+	case settings.window < constant.MIN_CIRCUIT_BREAKER_WINDOW:
+		return nil, fmt.Errorf("invalid %s %v, must be at least %v", constant.CIRCUIT_BREAKER_WINDOW, cb.Window, constant.MIN_CIRCUIT_BREAKER_WINDOW)
+	case settings.errorRate < 0 || settings.errorRate > 1:
+		return nil, fmt.Errorf("invalid %s %v, must be between 0 and 1", constant.CIRCUIT_BREAKER_ERROR_RATE, cb.ErrorRate)
+	case settings.minRequests < 0:
+		return nil, fmt.Errorf("invalid %s %d", constant.CIRCUIT_BREAKER_MIN_REQUESTS, cb.MinRequests)
+	case settings.consecutiveFailures < 0:
+		return nil, fmt.Errorf("invalid %s %d", constant.CIRCUIT_BREAKER_CONSECUTIVE_FAILURES, settings.consecutiveFailures)
+	case settings.halfOpenRequests < 0:
+		return nil, fmt.Errorf("invalid %s %d", constant.CIRCUIT_BREAKER_HALF_OPEN_REQUESTS, cb.HalfOpenRequests)
+	}
+	return settings, nil
+}
+
+// 熔断器状态
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStates = []string{"closed", "open", "half-open"}
+
+// 滑动窗口中的一个桶
+type breakerBucket struct {
+	epoch    int64 //桶对应的时间段编号
+	total    int
+	failures int
+}
+
+// 一个后端服务器的熔断器，为nil时不熔断
+type breaker struct {
+	settings    *breakerSettings
+	name        string //后端服务器池名，用于日志
+	addr        string
+	mu          sync.Mutex
+	state       int
+	since       time.Time //进入当前状态的时间
+	consecutive int       //连续失败次数
+	buckets     [constant.CIRCUIT_BREAKER_BUCKETS]breakerBucket
+	probes      int //半开状态已经放行的探测请求数
+	successes   int //半开状态成功的探测请求数
+}
+
+func newBreaker(settings *breakerSettings, name, addr string) *breaker {
+	if settings == nil {
+		return nil
+	}
+	return &breaker{settings: settings, name: name, addr: addr, since: time.Now()}
+}
+
+// 是否可以参与选择，不改变状态
+func (b *breaker) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allow(time.Now(), false)
+}
+
+// 选中后占用一个请求名额，打开状态到期时进入半开状态。返回false时不能发送请求
+func (b *breaker) acquire() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allow(time.Now(), true)
+}
+
+func (b *breaker) allow(now time.Time, acquire bool) bool {
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.since) < b.settings.openTimeout {
+			return false
+		}
+		if acquire {
+			b.transition(breakerHalfOpen, now)
+			b.probes = 1
+		}
+		return true
+	case breakerHalfOpen:
+		//探测请求一直没有结果（例如客户端断开）时，超时后重新放行
+		stale := now.Sub(b.since) >= b.settings.openTimeout
+		if b.probes >= b.settings.halfOpenRequests && !stale {
+			return false
+		}
+		if acquire {
+			if stale {
+				b.since, b.probes, b.successes = now, 0, 0
+			}
+			b.probes++
+		}
+		return true
+	}
+	return true
+}
+
+// 记录请求结果
+func (b *breaker) record(success bool) {
+	if b == nil {
+		return
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		//熔断之前发出的请求，忽略
+		return
+	case breakerHalfOpen:
+		if !success {
+			b.transition(breakerOpen, now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.settings.halfOpenRequests {
+			b.transition(breakerClosed, now)
+		}
+		return
+	}
+	//桶的时长不能为0，否则除零
+	width := b.settings.window / constant.CIRCUIT_BREAKER_BUCKETS
+	if width < constant.MIN_CIRCUIT_BREAKER_BUCKET {
+		width = constant.MIN_CIRCUIT_BREAKER_BUCKET
+	}
+	epoch := now.UnixNano() / int64(width)
+	bucket := &b.buckets[epoch%constant.CIRCUIT_BREAKER_BUCKETS]
+	if bucket.epoch != epoch {
+		*bucket = breakerBucket{epoch: epoch}
+	}
+	bucket.total++
+	if success {
+		b.consecutive = 0
+		return
+	}
+	bucket.failures++
+	b.consecutive++
+	if b.settings.consecutiveFailures > 0 && b.consecutive >= b.settings.consecutiveFailures {
+		b.transition(breakerOpen, now)
+		return
+	}
+	var total, failures int
+	for _, bucket := range b.buckets {
+		if epoch-bucket.epoch < constant.CIRCUIT_BREAKER_BUCKETS {
+			total += bucket.total
+			failures += bucket.failures
+		}
+	}
+	if total >= b.settings.minRequests && float64(failures) >= b.settings.errorRate*float64(total) {
+		b.transition(breakerOpen, now)
+	}
+}
+
+// 切换状态并打印日志，调用方需持有b.mu
+func (b *breaker) transition(state int, now time.Time) {
+	logger.Warnf("后端服务器池 %s 后端服务器 %s 熔断器 %s -> %s", b.name, b.addr, breakerStates[b.state], breakerStates[state])
+	b.state = state
+	b.since = now
+	b.consecutive = 0
+	b.probes = 0
+	b.successes = 0
+	b.buckets = [constant.CIRCUIT_BREAKER_BUCKETS]breakerBucket{}
+}
@@ -4,12 +4,16 @@ package core
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"net"
 	"net/http"
-	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/hellobchain/nginxgo/common/constant"
 )
@@ -18,28 +22,61 @@ var NginxConfigFilepath string
 
 // 配置文件结构
 type config struct {
-	Service  []service            `json:"service"`
+	Service  []*service           `json:"service"`
 	Upstream map[string]*upstream `json:"upstream"` //一个后端服务器池名对应多个后端服务器
+	//所有后端服务器池共用的默认配置，后端服务器池自己设置的值优先
+	UpstreamDefault *upstream         `json:"upstream_default,omitempty"`
+	files           []string          //配置依赖的所有文件，包括include进来的文件和引用的密钥文件
+	templates       map[string]string //替换过变量的值 -> 原始写法，输出日志时还原，避免泄露密钥
 }
 
 // upstream结构
 type upstream struct {
-	Addr           []string          `json:"addr"` //服务器地址
-	hashRing       *hashRing         //upstream对应的哈希环
-	Replicas       int               `json:"replicas"` //每个虚拟节点对应的真实节点数量
-	Scheme         string            `json:"scheme"`   //协议
-	failCount      map[string]int    //记录每个后端服务器的失败连接次数，超过三次就把这个服务器从这个池子里扬了
-	mu             sync.Mutex        //一把锁，用于热重启
-	ProxySetHeader []*proxySetHeader `json:"proxy_set_header"` // 代理请求头
+	Addr             []string                      `json:"addr"`               //服务器地址，可以带属性，例如"127.0.0.1:8080 weight=5 backup"
+	Replicas         int                           `json:"replicas,omitempty"` //每个虚拟节点对应的真实节点数量
+	Scheme           string                        `json:"scheme"`             //协议
+	replicasSet      bool                          //显式设置了replicas，用于区分没有设置和replicas=0
+	mu               sync.Mutex                    //一把锁，用于热重启
+	ProxySetHeader   []*proxySetHeader             `json:"proxy_set_header"`          // 代理请求头
+	ConnectTimeout   duration                      `json:"connect_timeout,omitempty"` //连接后端服务器超时
+	ReadTimeout      duration                      `json:"read_timeout,omitempty"`    //等待后端服务器响应头超时
+	Policy           string                        `json:"policy,omitempty"`          //负载均衡策略，默认ip_hash
+	HashKey          string                        `json:"hash_key,omitempty"`        //哈希键模板，默认为客户端ip
+	hashKey          hashKey                       //解析后的哈希键模板
+	LoadFactor       float64                       `json:"load_factor,omitempty"` //有界负载系数，节点负载超过平均负载的倍数时顺时针找下一个
+	FailStatus       string                        `json:"fail_status,omitempty"` //记为失败的响应状态码，不设置时只有连接错误和超时记为失败
+	failStatus       [][2]int                      //解析后的fail_status
+	SlowStart        duration                      `json:"slow_start,omitempty"`          //恢复或者新加入的后端服务器流量逐渐增加的时长，不设置时立即接收完整的流量
+	HealthCheck      *healthCheck                  `json:"health_check,omitempty"`        //主动健康检查，不设置时不检查
+	NextUpstream     *nextUpstream                 `json:"proxy_next_upstream,omitempty"` //请求失败时重试下一个后端服务器，不设置时连接错误和超时重试
+	retry            *retryPolicy                  //解析后的重试配置
+	Fallback         *fallback                     `json:"fallback,omitempty"`        //所有后端服务器都不可用时的响应，不设置时返回502
+	CircuitBreaker   *circuitBreaker               `json:"circuit_breaker,omitempty"` //每个后端服务器的熔断器，不设置时不熔断
+	breaker          *breakerSettings              //解析后的熔断器配置
+	OutlierDetection *outlierDetection             `json:"outlier_detection,omitempty"` //异常检测，不设置时不检测
+	outlier          *outlierSettings              //解析后的异常检测配置
+	Discovery        *discovery                    `json:"discovery,omitempty"` //服务发现，不设置时只使用addr
+	discoverer       *discoverer                   //解析后的服务发现配置
+	discovered       []string                      //服务发现得到的后端服务器，受mu保护
+	Sticky           *sticky                       `json:"sticky,omitempty"` //会话保持，不设置时按负载均衡策略选择
+	sticky           *stickySettings               //解析后的会话保持配置
+	state            atomic.Pointer[balancerState] //后端服务器和负载均衡器
+	cancel           context.CancelFunc            //停止后台任务
+	transport        http.RoundTripper             //按超时配置构建的transport
+	name             string                        //后端服务器池名
+	pos              srcPos                        //配置文件中的位置
+	addrPos          []srcPos                      //每个后端服务器在配置文件中的位置，与Addr对应
 }
 
 // service结构
 type service struct {
 	Port        string       `json:"port"` //定义监听的代理服务器端口号。一个端口号绑定一个service。
 	httpService *http.Server //定义一个http服务，用于启动代理服务器
+	listener    net.Listener //预先绑定的端口
+	handler     *swapHandler //路由，热重启时原子替换
+	mux         http.Handler //热重启时新构建的路由，切换后生效
 	Location    []*location  `json:"location"` //location结构
-	hashValue   uint64       //location哈希值的和。
-	mu          sync.Mutex   // 一把锁，用于热重启
+	pos         srcPos       //配置文件中的位置
 }
 
 // location结构
@@ -48,7 +85,8 @@ type location struct {
 	Root         string `json:"root"`      //根路径，会附加在service结构的根路径上
 	Upstream     string `json:"upstream"`  //使用的后端服务器池名
 	FileRoot     string `json:"file_root"` //fileRoot，文件路径，和root是两个东西了
-	hashValue    uint32 //location哈希值。用于验证location是否发生变化。
+	pos          srcPos //配置文件中的位置
+	upstreamPos  srcPos //upstream字段在配置文件中的位置
 }
 
 // proxySetHeader结构体
@@ -58,14 +96,77 @@ type proxySetHeader struct {
 }
 
 func readConfigFromFile(fileName string) config {
+	cfg, err := loadConfig(fileName)
+	if err != nil {
+		logger.Fatalf("read config file failed:\n%v", err)
+	}
+	printJsonCfg(cfg)
+	return cfg
+}
+
+// 读取并解析配置文件
+func parseConfigFile(fileName string) (config, error) {
+	return (&configReader{}).parse(fileName)
+}
+
+// 根据方言选择解析器
+func (reader *configReader) parse(fileName string) (config, error) {
+	data, err := reader.enter(fileName, srcPos{})
+	if err != nil {
+		return config{}, err
+	}
 	var cfg config
+	switch configDialect(fileName, data) {
+	case constant.DIALECT_NGINX:
+		cfg, err = parseNginxConfig(fileName, data, reader)
+	case constant.DIALECT_JSON:
+		cfg, err = parseJsonConfig(fileName, data, reader)
+	case constant.DIALECT_YAML:
+		cfg, err = parseYamlConfig(fileName, data, reader)
+	default:
+		cfg, err = parseCfgConfig(fileName, data, reader)
+	}
+	cfg.files = reader.files
+	cfg.templates = reader.templates
+	return cfg, err
+}
+
+// 判断配置文件方言。文件头部注释中有"# dialect=xxx"时以其为准，否则按扩展名判断
+func configDialect(fileName string, data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		header := strings.ReplaceAll(strings.TrimPrefix(line, "#"), " ", "")
+		if strings.HasPrefix(header, constant.DIALECT_HEADER) {
+			return strings.TrimPrefix(header, constant.DIALECT_HEADER)
+		}
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".conf", ".nginx":
+		return constant.DIALECT_NGINX
+	case ".json":
+		return constant.DIALECT_JSON
+	case ".yaml", ".yml":
+		return constant.DIALECT_YAML
+	}
+	return constant.DIALECT_CFG
+}
+
+// 解析[server]/[location]/[end]风格的配置
+func parseCfgConfig(fileName string, data []byte, reader *configReader) (config, error) {
+	var cfg config
+	var errs configErrors
 	cfg.Upstream = make(map[string]*upstream)
-	file, err := os.Open(fileName)
+	lines, err := reader.readCfgLines(fileName, data)
 	if err != nil {
-		logger.Fatalf("open config file failed: %v", err)
+		return cfg, err
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
 	//定义当前的type
 	const (
 		serviceType  = 1
@@ -75,119 +176,175 @@ func readConfigFromFile(fileName string) config {
 		endType      = 0
 	)
 	var nowType = 0
-	var serviceStruct service
-	var locationStruct location
-	var proxyStruct proxySetHeader
-	var upstreamName string
-	for scanner.Scan() {
-		line := scanner.Text()
+	var lineNum int
+	var serviceStruct *service
+	var locationStruct *location
+	var proxyStruct *proxySetHeader
+	var upstreamStruct *upstream
+	var isDefault bool //当前upstream块是否为[upstream_default]
+	//当前行位置
+	pos := func() srcPos {
+		return lines[lineNum].pos
+	}
+	for lineNum = range lines {
+		line := lines[lineNum].text
 		if isSkip(line) {
 			continue
 		}
 		//检测block
 		switch line {
 		case constant.BLOCK_SERVER:
+			if nowType != endType {
+				errs.add(pos(), "%s inside another block, missing %s", line, constant.BLOCK_END)
+			}
+			serviceStruct = &service{pos: pos()}
 			nowType = serviceType
 			continue
-		case constant.BLOCK_UPSTREAM:
+		case constant.BLOCK_UPSTREAM, constant.BLOCK_UPSTREAM_DEFAULT:
+			if nowType != endType {
+				errs.add(pos(), "%s inside another block, missing %s", line, constant.BLOCK_END)
+			}
+			upstreamStruct = &upstream{pos: pos()}
+			isDefault = line == constant.BLOCK_UPSTREAM_DEFAULT
 			nowType = upstreamType
 			continue
 		case constant.BLOCK_LOCATION:
+			if nowType != serviceType {
+				errs.add(pos(), "%s must be inside %s", line, constant.BLOCK_SERVER)
+				nowType = endType
+				continue
+			}
+			locationStruct = &location{pos: pos()}
 			nowType = locationType
 			continue
 		case constant.BLOCK_PROXY_SET_HEADER:
+			if nowType != upstreamType {
+				errs.add(pos(), "%s must be inside %s", line, constant.BLOCK_UPSTREAM)
+				nowType = endType
+				continue
+			}
+			proxyStruct = &proxySetHeader{}
 			nowType = proxyType
 			continue
 		case constant.BLOCK_END:
 			switch nowType {
 			case serviceType:
 				cfg.Service = append(cfg.Service, serviceStruct)
-				// 重置结构体
-				serviceStruct = service{}
 				nowType = endType
 			case locationType:
-				//复制一份
-				newLocation := locationStruct
-				serviceStruct.Location = append(serviceStruct.Location, &newLocation)
-				locationStruct = location{}
+				serviceStruct.Location = append(serviceStruct.Location, locationStruct)
 				nowType = serviceType
 			case upstreamType:
-				upstreamName = ""
+				if isDefault {
+					if cfg.UpstreamDefault != nil {
+						errs.add(upstreamStruct.pos, "duplicate %s", constant.BLOCK_UPSTREAM_DEFAULT)
+					}
+					cfg.UpstreamDefault = upstreamStruct
+				} else if upstreamStruct.name == "" {
+					errs.add(upstreamStruct.pos, "upstream without %s", constant.BLOCK_UPSTREAM_NAME)
+				} else if _, ok := cfg.Upstream[upstreamStruct.name]; ok {
+					errs.add(upstreamStruct.pos, "duplicate upstream %q", upstreamStruct.name)
+				} else {
+					cfg.Upstream[upstreamStruct.name] = upstreamStruct
+				}
 				nowType = endType
 			case proxyType:
-				//复制一份
-				newProxySetHeader := proxyStruct
-				cfg.Upstream[upstreamName].ProxySetHeader = append(cfg.Upstream[upstreamName].ProxySetHeader, &newProxySetHeader)
-				proxyStruct = proxySetHeader{}
+				upstreamStruct.ProxySetHeader = append(upstreamStruct.ProxySetHeader, proxyStruct)
 				nowType = upstreamType
+			default:
+				errs.add(pos(), "unexpected %s", constant.BLOCK_END)
 			}
 			continue
 		}
+		s := strings.SplitN(line, "=", 2)
+		key := s[0]
 		//检查目前字段所处区块
 		switch nowType {
+		case endType:
+			errs.add(pos(), "%q outside of any block", line)
+			continue
+		case upstreamType:
+			//后端服务器行以地址开头，地址不带"="，后面可以跟属性
+			if fields := strings.Fields(line); !isDefault && len(fields) > 0 && !strings.Contains(fields[0], "=") {
+				upstreamStruct.Addr = append(upstreamStruct.Addr, reader.expandValue(line, pos(), &errs))
+				upstreamStruct.addrPos = append(upstreamStruct.addrPos, pos())
+				continue
+			}
+		}
+		if len(s) == 1 {
+			errs.add(pos(), "expecting key=value, got %q", line)
+			continue
+		}
+		value := reader.expandValue(s[1], pos(), &errs)
+		switch nowType {
 		//处理service区块
 		case serviceType:
-			s := strings.Split(line, "=")
-			switch s[0] {
+			switch key {
 			case constant.BLOCK_SERVER_PORT:
-				serviceStruct.Port = s[1]
+				serviceStruct.Port = value
+			default:
+				errs.add(pos(), "unknown key %q in %s", key, constant.BLOCK_SERVER)
 			}
 		case upstreamType:
-			s := strings.Split(line, "=")
-			switch s[0] {
-			case constant.BLOCK_UPSTREAM_NAME:
-				upstreamName = s[1]
-				cfg.Upstream[upstreamName] = &upstream{}
-				cfg.Upstream[upstreamName].failCount = make(map[string]int)
-			case constant.BLOCK_UPSTREAM_REPLICAS:
-				replicas, err := strconv.Atoi(s[1])
-				if err != nil {
-					logger.Fatalf("replicas 字段设置错误：%v", err)
-				}
-				cfg.Upstream[upstreamName].Replicas = replicas
-			case constant.BLOCK_UPSTREAM_SCHEMA:
-				cfg.Upstream[upstreamName].Scheme = s[1]
-			default:
-				cfg.Upstream[upstreamName].Addr = append(cfg.Upstream[upstreamName].Addr, s[0])
+			if key == constant.BLOCK_UPSTREAM_NAME && !isDefault {
+				upstreamStruct.name = value
+			} else if err := upstreamStruct.setOption(key, value); err != nil {
+				errs.add(pos(), "%v", err)
 			}
 		case locationType:
-			s := strings.Split(line, "=")
-			switch s[0] {
+			switch key {
 			case constant.BLOCK_LOCATION_TYPE:
-				typeNum, err := strconv.Atoi(s[1])
+				typeNum, err := strconv.Atoi(value)
 				if err != nil {
-					logger.Fatalf("location type字段设置错误:%v", err)
+					errs.add(pos(), "location type字段设置错误：%q is not a number", value)
+					continue
 				}
 				locationStruct.LocationType = typeNum
 			case constant.BLOCK_LOCATION_ROOT:
-				locationStruct.Root = s[1]
+				locationStruct.Root = value
 			case constant.BLOCK_LOCATION_UPSTREAM:
-				locationStruct.Upstream = s[1]
+				locationStruct.Upstream = value
+				locationStruct.upstreamPos = pos()
 			case constant.BLOCK_LOCATION_FILE_ROOT:
-				locationStruct.FileRoot = s[1]
+				locationStruct.FileRoot = value
+			default:
+				errs.add(pos(), "unknown key %q in %s", key, constant.BLOCK_LOCATION)
 			}
 		case proxyType:
-			s := strings.Split(line, "=")
-			switch s[0] {
+			switch key {
 			case constant.BLOCK_PROXY_SET_HEADER_KEY:
-				proxyStruct.HeaderName = s[1]
+				proxyStruct.HeaderName = value
 			case constant.BLOCK_PROXY_SET_HEADER_VALUE:
-				proxyStruct.HeaderValue = s[1]
+				proxyStruct.HeaderValue = value
+			default:
+				errs.add(pos(), "unknown key %q in %s", key, constant.BLOCK_PROXY_SET_HEADER)
 			}
 		}
 	}
-	printJsonCfg(cfg)
-	return cfg
+	//未闭合的区块
+	switch nowType {
+	case serviceType:
+		errs.add(serviceStruct.pos, "%s is not closed by %s", constant.BLOCK_SERVER, constant.BLOCK_END)
+	case locationType:
+		errs.add(locationStruct.pos, "%s is not closed by %s", constant.BLOCK_LOCATION, constant.BLOCK_END)
+		errs.add(serviceStruct.pos, "%s is not closed by %s", constant.BLOCK_SERVER, constant.BLOCK_END)
+	case upstreamType, proxyType:
+		errs.add(upstreamStruct.pos, "%s is not closed by %s", constant.BLOCK_UPSTREAM, constant.BLOCK_END)
+	}
+	return cfg, errs.err()
 }
 
 func printJsonCfg(cfg config) {
 	ret, _ := json.MarshalIndent(cfg, "", " ")
-	logger.Infof("nginxgo config: %s", string(ret))
+	logger.Infof("nginxgo config: %s", unexpand(string(ret), logTemplates(cfg)))
 }
 
 // 读取配置文件
 func readConfig(engine *Engine) {
-	engine.writeEngine(readConfigFromFile(NginxConfigFilepath))
+	cfg := readConfigFromFile(NginxConfigFilepath)
+	applied := snapshotConfig(cfg)
+	engine.writeEngine(cfg)
+	recordSnapshot(applied)
 }
 
 // 跳过检测。
@@ -0,0 +1,238 @@
+package core
+
+//配置检查
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 配置文件中的位置
+type srcPos struct {
+	file string
+	line int
+}
+
+func (p srcPos) String() string {
+	if p.line == 0 {
+		return p.file
+	}
+	return fmt.Sprintf("%s:%d", p.file, p.line)
+}
+
+// 一条配置错误
+type diagnostic struct {
+	pos srcPos
+	msg string
+}
+
+// 配置错误集合，每条错误带文件名和行号
+type configErrors []diagnostic
+
+func (errs *configErrors) add(pos srcPos, format string, args ...interface{}) {
+	*errs = append(*errs, diagnostic{pos: pos, msg: fmt.Sprintf(format, args...)})
+}
+
+func (errs configErrors) Error() string {
+	lines := make([]string, 0, len(errs))
+	for _, d := range errs {
+		lines = append(lines, d.pos.String()+": "+d.msg)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 没有错误时返回nil，避免返回非nil的空接口
+func (errs configErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// CheckConfig 解析并校验配置文件，返回所有错误
+func CheckConfig(fileName string) error {
+	_, err := loadConfig(fileName)
+	return err
+}
+
+// 解析配置文件，填充默认值并进行语义校验
+func loadConfig(fileName string) (config, error) {
+	cfg, err := parseConfigFile(fileName)
+	var errs configErrors
+	if err != nil {
+		parseErrs, ok := err.(configErrors)
+		if !ok {
+			return cfg, err
+		}
+		errs = append(errs, parseErrs...)
+	}
+	applyDefaults(&cfg)
+	errs = append(errs, validateConfig(cfg)...)
+	sortDiagnostics(errs)
+	return cfg, errs.err()
+}
+
+// 填充默认值，先继承默认块，再使用内置默认值
+func applyDefaults(cfg *config) {
+	for _, u := range cfg.Upstream {
+		if cfg.UpstreamDefault != nil {
+			u.inherit(cfg.UpstreamDefault)
+		}
+		//显式设置的replicas=0留给validateConfig报错
+		if !u.replicasSet && u.Replicas == 0 {
+			u.Replicas = 1
+		}
+		if u.Scheme == "" {
+			u.Scheme = "http"
+		}
+	}
+}
+
+// 语义校验：端口、location、upstream引用等
+func validateConfig(cfg config) configErrors {
+	var errs configErrors
+	ports := make(map[string]srcPos)
+	for _, s := range cfg.Service {
+		if s.Port == "" {
+			errs.add(s.pos, "server without port")
+		} else if port, err := strconv.Atoi(s.Port); err != nil || port < 1 || port > 65535 {
+			errs.add(s.pos, "invalid port %q", s.Port)
+		} else if first, ok := ports[s.Port]; ok {
+			errs.add(s.pos, "duplicate port %s, first defined at %s", s.Port, first)
+		} else {
+			ports[s.Port] = s.pos
+		}
+		roots := make(map[string]srcPos)
+		for _, l := range s.Location {
+			root := l.Root
+			if root == "" {
+				root = "/"
+			}
+			if !strings.HasPrefix(root, "/") {
+				errs.add(l.pos, "location root %q must start with \"/\"", l.Root)
+			} else if first, ok := roots[root]; ok {
+				errs.add(l.pos, "duplicate location %q, first defined at %s", root, first)
+			} else {
+				roots[root] = l.pos
+			}
+			switch l.LocationType {
+			case constant.LOCATION_LOADBALANCING:
+				upstreamPos := l.upstreamPos
+				if upstreamPos.line == 0 {
+					upstreamPos = l.pos
+				}
+				if l.Upstream == "" {
+					errs.add(l.pos, "load balancing location without upstream")
+				} else if _, ok := cfg.Upstream[l.Upstream]; !ok {
+					errs.add(upstreamPos, "upstream %q is not defined", l.Upstream)
+				}
+			case constant.LOCATION_FILESERVICE:
+				if l.FileRoot == "" {
+					errs.add(l.pos, "file location without file_root")
+				}
+			default:
+				errs.add(l.pos, "invalid location type %d", l.LocationType)
+			}
+		}
+	}
+	if cfg.UpstreamDefault != nil && len(cfg.UpstreamDefault.Addr) > 0 {
+		errs.add(cfg.UpstreamDefault.pos, "backend servers are not allowed in upstream default")
+	}
+	if cfg.UpstreamDefault != nil && cfg.UpstreamDefault.Discovery != nil {
+		errs.add(cfg.UpstreamDefault.pos, "%s is not allowed in upstream default", constant.DISCOVERY)
+	}
+	if cfg.UpstreamDefault != nil && cfg.UpstreamDefault.replicasSet && cfg.UpstreamDefault.Replicas < 1 {
+		errs.add(cfg.UpstreamDefault.pos, "upstream default: invalid replicas %d", cfg.UpstreamDefault.Replicas)
+	}
+	for name, u := range cfg.Upstream {
+		if u.Replicas < 1 {
+			errs.add(u.pos, "upstream %q: invalid replicas %d", name, u.Replicas)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			errs.add(u.pos, "upstream %q: invalid scheme %q", name, u.Scheme)
+		}
+		//JSON/YAML配置不经过setOption，在这里检查
+		if _, ok := balancers[u.Policy]; u.Policy != "" && !ok {
+			errs.add(u.pos, "upstream %q: unknown policy %q", name, u.Policy)
+		}
+		if u.LoadFactor != 0 && u.LoadFactor < 1 {
+			errs.add(u.pos, "upstream %q: invalid load_factor %v, must be >= 1", name, u.LoadFactor)
+		}
+		if u.FailStatus != "" {
+			if _, err := parseStatusRanges(u.FailStatus); err != nil {
+				errs.add(u.pos, "upstream %q: %s: %v", name, constant.BLOCK_UPSTREAM_FAIL_STATUS, err)
+			}
+		}
+		if u.HealthCheck != nil {
+			if _, err := u.HealthCheck.compile(); err != nil {
+				errs.add(u.pos, "upstream %q: %v", name, err)
+			}
+		}
+		if u.Fallback != nil {
+			if err := u.Fallback.validate(); err != nil {
+				errs.add(u.pos, "upstream %q: %v", name, err)
+			}
+		}
+		if u.CircuitBreaker != nil {
+			if _, err := u.CircuitBreaker.compile(); err != nil {
+				errs.add(u.pos, "upstream %q: %v", name, err)
+			}
+		}
+		if u.Sticky != nil {
+			if _, err := u.Sticky.compile(name); err != nil {
+				errs.add(u.pos, "upstream %q: %v", name, err)
+			}
+		}
+		if u.Discovery != nil {
+			if _, err := u.Discovery.compile(); err != nil {
+				errs.add(u.pos, "upstream %q: %v", name, err)
+			}
+		}
+		if u.OutlierDetection != nil {
+			if _, err := u.OutlierDetection.compile(); err != nil {
+				errs.add(u.pos, "upstream %q: %v", name, err)
+			}
+		}
+		if _, err := u.NextUpstream.compile(); err != nil {
+			errs.add(u.pos, "upstream %q: %v", name, err)
+		}
+		if _, err := parseHashKey(u.HashKey); err != nil {
+			errs.add(u.pos, "upstream %q: %v", name, err)
+		}
+		if len(u.Addr) == 0 && u.Discovery == nil {
+			errs.add(u.pos, "upstream %q has no backend servers", name)
+		}
+		seen := make(map[string]bool)
+		for i, line := range u.Addr {
+			//JSON/YAML没有行号，使用upstream的位置
+			pos := u.pos
+			if i < len(u.addrPos) {
+				pos = u.addrPos[i]
+			}
+			b, err := parseBackend(line)
+			if err != nil {
+				errs.add(pos, "upstream %q: %v", name, err)
+				continue
+			}
+			if seen[b.addr] {
+				errs.add(pos, "upstream %q: duplicate backend %s", name, b.addr)
+			}
+			seen[b.addr] = true
+		}
+	}
+	return errs
+}
+
+// 按文件和行号排序，方便阅读
+func sortDiagnostics(errs configErrors) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].pos.file != errs[j].pos.file {
+			return errs[i].pos.file < errs[j].pos.file
+		}
+		return errs[i].pos.line < errs[j].pos.line
+	})
+}
@@ -0,0 +1,276 @@
+package core
+
+//JSON/YAML格式的配置读写，以及格式转换
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+	"sigs.k8s.io/yaml"
+)
+
+// 解析JSON格式的配置，字段与printJsonCfg输出的一致
+func parseJsonConfig(fileName string, data []byte, reader *configReader) (config, error) {
+	var cfg config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+			return cfg, fmt.Errorf("%s:%d: %v", fileName, line, err)
+		}
+		return cfg, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return reader.completeConfig(fileName, cfg)
+}
+
+// 解析YAML格式的配置。先转换为JSON，沿用json标签
+func parseYamlConfig(fileName string, data []byte, reader *configReader) (config, error) {
+	var cfg config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return reader.completeConfig(fileName, cfg)
+}
+
+// 不带UnmarshalJSON方法的upstream，避免递归
+type plainUpstream upstream
+
+// 解析JSON/YAML中的后端服务器池，记录是否设置了replicas，没有设置时才使用默认值
+func (upstream *upstream) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode((*plainUpstream)(upstream)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	_, upstream.replicasSet = fields[constant.BLOCK_UPSTREAM_REPLICAS]
+	return nil
+}
+
+// 补全JSON/YAML中没有的字段，并替换环境变量
+func (reader *configReader) completeConfig(fileName string, cfg config) (config, error) {
+	var errs configErrors
+	pos := srcPos{file: fileName}
+	if cfg.Upstream == nil {
+		cfg.Upstream = make(map[string]*upstream)
+	}
+	for i, s := range cfg.Service {
+		if s == nil {
+			errs.add(pos, "service[%d] is null", i)
+			s = &service{}
+			cfg.Service[i] = s
+		}
+		s.pos = pos
+		for j, l := range s.Location {
+			if l == nil {
+				errs.add(pos, "service[%d].location[%d] is null", i, j)
+				l = &location{}
+				s.Location[j] = l
+			}
+			l.pos = pos
+		}
+	}
+	if cfg.UpstreamDefault != nil {
+		cfg.UpstreamDefault.pos = pos
+	}
+	for name, u := range cfg.Upstream {
+		if u == nil {
+			errs.add(pos, "upstream %q is null", name)
+			u = &upstream{}
+			cfg.Upstream[name] = u
+		}
+		u.name = name
+		u.pos = pos
+	}
+	reader.expandStrings(reflect.ValueOf(&cfg).Elem(), pos, &errs)
+	return cfg, errs.err()
+}
+
+// 替换所有导出的字符串字段中的环境变量，与另外两种方言替换所有配置值一致
+func (reader *configReader) expandStrings(v reflect.Value, pos srcPos, errs *configErrors) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			reader.expandStrings(v.Elem(), pos, errs)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				reader.expandStrings(v.Field(i), pos, errs)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			reader.expandStrings(v.Index(i), pos, errs)
+		}
+	case reflect.Map:
+		//map中的值不可寻址，只处理指针。按key排序，错误输出稳定
+		if v.Type().Elem().Kind() == reflect.Ptr {
+			keys := v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, key := range keys {
+				reader.expandStrings(v.MapIndex(key), pos, errs)
+			}
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(reader.expandValue(v.String(), pos, errs))
+		}
+	}
+}
+
+// 按[server]风格输出配置
+func marshalCfgConfig(cfg config) []byte {
+	var b bytes.Buffer
+	line := func(s string) {
+		b.WriteString(s)
+		b.WriteByte('\n')
+	}
+	kv := func(key, value string) {
+		line(key + "=" + value)
+	}
+	for _, s := range cfg.Service {
+		line(constant.BLOCK_SERVER)
+		kv(constant.BLOCK_SERVER_PORT, s.Port)
+		for _, l := range s.Location {
+			line(constant.BLOCK_LOCATION)
+			kv(constant.BLOCK_LOCATION_TYPE, strconv.Itoa(l.LocationType))
+			kv(constant.BLOCK_LOCATION_ROOT, l.Root)
+			kv(constant.BLOCK_LOCATION_UPSTREAM, l.Upstream)
+			kv(constant.BLOCK_LOCATION_FILE_ROOT, l.FileRoot)
+			line(constant.BLOCK_END)
+		}
+		line(constant.BLOCK_END)
+		line("")
+	}
+	upstreamBlock := func(u *upstream) {
+		for _, option := range u.options() {
+			kv(option[0], option[1])
+		}
+		for _, header := range u.ProxySetHeader {
+			line(constant.BLOCK_PROXY_SET_HEADER)
+			kv(constant.BLOCK_PROXY_SET_HEADER_KEY, header.HeaderName)
+			kv(constant.BLOCK_PROXY_SET_HEADER_VALUE, header.HeaderValue)
+			line(constant.BLOCK_END)
+		}
+		for _, addr := range u.Addr {
+			line(addr)
+		}
+		line(constant.BLOCK_END)
+		line("")
+	}
+	if cfg.UpstreamDefault != nil {
+		line(constant.BLOCK_UPSTREAM_DEFAULT)
+		upstreamBlock(cfg.UpstreamDefault)
+	}
+	for _, name := range sortedKeys(cfg.Upstream) {
+		line(constant.BLOCK_UPSTREAM)
+		kv(constant.BLOCK_UPSTREAM_NAME, name)
+		upstreamBlock(cfg.Upstream[name])
+	}
+	return b.Bytes()
+}
+
+// 按nginx风格输出配置。文件服务的location不保留upstream字段
+func marshalNginxConfig(cfg config) []byte {
+	var b bytes.Buffer
+	directive := func(indent int, name string, args ...string) {
+		b.WriteString(strings.Repeat("    ", indent))
+		b.WriteString(name)
+		for _, arg := range args {
+			b.WriteByte(' ')
+			b.WriteString(quoteNginxArg(arg))
+		}
+		b.WriteString(";\n")
+	}
+	for _, s := range cfg.Service {
+		b.WriteString(constant.DIRECTIVE_SERVER + " {\n")
+		directive(1, constant.DIRECTIVE_LISTEN, s.Port)
+		for _, l := range s.Location {
+			b.WriteString("    " + constant.DIRECTIVE_LOCATION + " " + quoteNginxArg(l.Root) + " {\n")
+			switch l.LocationType {
+			case constant.LOCATION_LOADBALANCING:
+				directive(2, constant.DIRECTIVE_PROXY_PASS, l.Upstream)
+			case constant.LOCATION_FILESERVICE:
+				directive(2, constant.DIRECTIVE_FILE_ROOT, l.FileRoot)
+			}
+			b.WriteString("    }\n")
+		}
+		b.WriteString("}\n\n")
+	}
+	upstreamBlock := func(u *upstream) {
+		for _, option := range u.options() {
+			key := option[0]
+			if key == constant.BLOCK_UPSTREAM_SCHEMA {
+				key = constant.DIRECTIVE_SCHEME
+			}
+			directive(1, key, option[1])
+		}
+		for _, header := range u.ProxySetHeader {
+			directive(1, constant.DIRECTIVE_PROXY_SET_HEADER, header.HeaderName, header.HeaderValue)
+		}
+		for _, addr := range u.Addr {
+			directive(1, constant.DIRECTIVE_SERVER, strings.Fields(addr)...)
+		}
+		b.WriteString("}\n\n")
+	}
+	if cfg.UpstreamDefault != nil {
+		b.WriteString(constant.DIRECTIVE_UPSTREAM_DEFAULT + " {\n")
+		upstreamBlock(cfg.UpstreamDefault)
+	}
+	for _, name := range sortedKeys(cfg.Upstream) {
+		b.WriteString(constant.DIRECTIVE_UPSTREAM + " " + quoteNginxArg(name) + " {\n")
+		upstreamBlock(cfg.Upstream[name])
+	}
+	return b.Bytes()
+}
+
+// 参数为空或者包含特殊字符时加引号
+func quoteNginxArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n;{}#\"'\\") {
+		return arg
+	}
+	replacer := strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+	return "\"" + replacer.Replace(arg) + "\""
+}
+
+// 按文件扩展名选择输出格式
+func marshalConfig(cfg config, fileName string) ([]byte, error) {
+	switch configDialect(fileName, nil) {
+	case constant.DIALECT_JSON:
+		data, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	case constant.DIALECT_YAML:
+		return yaml.Marshal(cfg)
+	case constant.DIALECT_NGINX:
+		return marshalNginxConfig(cfg), nil
+	}
+	return marshalCfgConfig(cfg), nil
+}
+
+// ConvertConfig 转换配置文件格式，输出格式由dst的扩展名决定。环境变量保持原样，include的文件会被合并
+func ConvertConfig(src, dst string) error {
+	cfg, err := (&configReader{raw: true}).parse(src)
+	if err != nil {
+		return err
+	}
+	data, err := marshalConfig(cfg, dst)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
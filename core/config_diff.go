@@ -0,0 +1,210 @@
+package core
+
+//新旧配置的结构化比对，决定热重启时需要重建的监听和后端服务器池
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 配置变化
+type configDiff struct {
+	addedServices    map[string]bool //新增的端口
+	changedServices  map[string]bool //location发生变化的端口
+	removedServices  map[string]bool //删除的端口
+	addedUpstreams   map[string]bool
+	changedUpstreams map[string]bool
+	removedUpstreams map[string]bool
+	changes          []string          //可读的变化描述
+	oldTemplates     map[string]string //旧配置中替换过变量的值和密钥，输出时还原为原始写法或者隐藏
+	newTemplates     map[string]string
+}
+
+func (diff *configDiff) addf(format string, args ...interface{}) {
+	diff.changes = append(diff.changes, fmt.Sprintf(format, args...))
+}
+
+// 是否没有任何变化
+func (diff *configDiff) empty() bool {
+	return len(diff.changes) == 0
+}
+
+// 可读的变化摘要
+func (diff *configDiff) String() string {
+	if diff.empty() {
+		return "no changes"
+	}
+	return strings.Join(diff.changes, "\n")
+}
+
+// 比对新旧配置
+func diffConfig(old, new config) *configDiff {
+	diff := &configDiff{
+		addedServices:    make(map[string]bool),
+		changedServices:  make(map[string]bool),
+		removedServices:  make(map[string]bool),
+		addedUpstreams:   make(map[string]bool),
+		changedUpstreams: make(map[string]bool),
+		removedUpstreams: make(map[string]bool),
+		oldTemplates:     logTemplates(old),
+		newTemplates:     logTemplates(new),
+	}
+	oldServices := servicesByPort(old.Service)
+	newServices := servicesByPort(new.Service)
+	for _, port := range sortedKeys(newServices) {
+		s := newServices[port]
+		src, ok := oldServices[port]
+		if !ok {
+			diff.addedServices[port] = true
+			diff.addf("server :%s added", port)
+			continue
+		}
+		if diffLocations(diff, port, src.Location, s.Location) {
+			diff.changedServices[port] = true
+		}
+	}
+	for _, port := range sortedKeys(oldServices) {
+		if _, ok := newServices[port]; !ok {
+			diff.removedServices[port] = true
+			diff.addf("server :%s removed", port)
+		}
+	}
+
+	for _, name := range sortedKeys(new.Upstream) {
+		u := new.Upstream[name]
+		src, ok := old.Upstream[name]
+		if !ok {
+			diff.addedUpstreams[name] = true
+			diff.addf("upstream %s added", name)
+			continue
+		}
+		if diffUpstream(diff, name, src, u) {
+			diff.changedUpstreams[name] = true
+		}
+	}
+	for _, name := range sortedKeys(old.Upstream) {
+		if _, ok := new.Upstream[name]; !ok {
+			diff.removedUpstreams[name] = true
+			diff.addf("upstream %s removed", name)
+		}
+	}
+	return diff
+}
+
+// 比对一个端口下的location，按路径对应
+func diffLocations(diff *configDiff, port string, old, new []*location) bool {
+	oldLocations := locationsByRoot(old)
+	newLocations := locationsByRoot(new)
+	changed := false
+	for _, root := range sortedKeys(newLocations) {
+		src, ok := oldLocations[root]
+		if !ok {
+			diff.addf("server :%s: location %s added", port, root)
+			changed = true
+			continue
+		}
+		for _, field := range diff.fields(jsonFields(src), jsonFields(newLocations[root])) {
+			diff.addf("server :%s: location %s: %s", port, root, field)
+			changed = true
+		}
+	}
+	for _, root := range sortedKeys(oldLocations) {
+		if _, ok := newLocations[root]; !ok {
+			diff.addf("server :%s: location %s removed", port, root)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// 比对后端服务器池。后端服务器按集合比对，其余字段逐个比对
+func diffUpstream(diff *configDiff, name string, old, new *upstream) bool {
+	changed := false
+	oldAddr := make(map[string]bool)
+	for _, addr := range old.Addr {
+		oldAddr[addr] = true
+	}
+	newAddr := make(map[string]bool)
+	for _, addr := range new.Addr {
+		newAddr[addr] = true
+		if !oldAddr[addr] {
+			diff.addf("upstream %s: backend %s added", name, addr)
+			changed = true
+		}
+	}
+	for _, addr := range old.Addr {
+		if !newAddr[addr] {
+			diff.addf("upstream %s: backend %s removed", name, addr)
+			changed = true
+		}
+	}
+	oldFields, newFields := jsonFields(old), jsonFields(new)
+	delete(oldFields, "addr")
+	delete(newFields, "addr")
+	for _, field := range diff.fields(oldFields, newFields) {
+		diff.addf("upstream %s: %s", name, field)
+		changed = true
+	}
+	return changed
+}
+
+// 按json字段比对两个配置对象，返回"字段: 旧值 -> 新值"形式的描述。
+// 比对替换后的值，输出时还原为原始写法，密钥文件内容变化时只显示字段有变化
+func (diff *configDiff) fields(oldFields, newFields map[string]string) []string {
+	var changes []string
+	for _, key := range sortedKeys(newFields) {
+		if oldFields[key] != newFields[key] {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, unexpand(oldFields[key], diff.oldTemplates), unexpand(newFields[key], diff.newTemplates)))
+		}
+	}
+	for _, key := range sortedKeys(oldFields) {
+		if _, ok := newFields[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: %s -> null", key, unexpand(oldFields[key], diff.oldTemplates)))
+		}
+	}
+	return changes
+}
+
+// 配置对象的json字段，字段名 -> json值
+func jsonFields(v interface{}) map[string]string {
+	data, _ := json.Marshal(v)
+	var raw map[string]json.RawMessage
+	json.Unmarshal(data, &raw)
+	fields := make(map[string]string)
+	for key, value := range raw {
+		fields[key] = string(value)
+	}
+	return fields
+}
+
+func servicesByPort(services []*service) map[string]*service {
+	m := make(map[string]*service)
+	for _, s := range services {
+		m[s.Port] = s
+	}
+	return m
+}
+
+func locationsByRoot(locations []*location) map[string]*location {
+	m := make(map[string]*location)
+	for _, l := range locations {
+		root := l.Root
+		if root == "" {
+			root = "/"
+		}
+		m[root] = l
+	}
+	return m
+}
+
+// map的key排序，保证输出稳定
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,125 @@
+package core
+
+//配置值中的环境变量和密钥文件替换
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const secretFilePrefix = "file:"
+
+// 替换配置值中的${VAR}、${VAR:-default}和${file:/path}，"$$"表示"$"本身。
+// onFile不为nil时，每读取一个密钥文件调用一次
+func interpolate(value string, onFile func(path string)) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '$' || i+1 >= len(value) {
+			sb.WriteByte(c)
+			continue
+		}
+		switch value[i+1] {
+		case '$':
+			sb.WriteByte('$')
+			i++
+			continue
+		case '{':
+		default:
+			sb.WriteByte(c)
+			continue
+		}
+		end := strings.IndexByte(value[i+2:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated \"${\" in %q", value)
+		}
+		expr := value[i+2 : i+2+end]
+		replaced, err := expandExpr(expr, onFile)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(replaced)
+		i += end + 2
+	}
+	return sb.String(), nil
+}
+
+// 计算${}中的表达式
+func expandExpr(expr string, onFile func(path string)) (string, error) {
+	if strings.HasPrefix(expr, secretFilePrefix) {
+		path := strings.TrimPrefix(expr, secretFilePrefix)
+		if onFile != nil {
+			onFile(path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read secret file: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	name, def, hasDefault := expr, "", false
+	if i := strings.Index(expr, ":-"); i >= 0 {
+		name, def, hasDefault = expr[:i], expr[i+2:], true
+	}
+	if name == "" {
+		return "", fmt.Errorf("empty variable name in \"${%s}\"", expr)
+	}
+	value, ok := os.LookupEnv(name)
+	if hasDefault && value == "" {
+		return def, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("environment variable %q is not set", name)
+	}
+	return value, nil
+}
+
+// 替换配置值，出错时记录带位置的错误并返回原值
+func (reader *configReader) expandValue(value string, pos srcPos, errs *configErrors) string {
+	if reader.raw {
+		return value
+	}
+	expanded, err := interpolate(value, reader.addFile)
+	if err != nil {
+		errs.add(pos, "%v", err)
+		return value
+	}
+	if expanded != value && expanded != "" {
+		if reader.templates == nil {
+			reader.templates = make(map[string]string)
+		}
+		reader.templates[expanded] = value
+	}
+	return expanded
+}
+
+// 把JSON中替换过变量的字符串还原为原始写法，输出日志时使用，避免泄露环境变量和密钥文件的内容
+func unexpand(data string, templates map[string]string) string {
+	if len(templates) == 0 {
+		return data
+	}
+	values := make([]string, 0, len(templates))
+	for value := range templates {
+		values = append(values, value)
+	}
+	//长的优先，结果稳定
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	var pairs []string
+	for _, value := range values {
+		quoted, _ := json.Marshal(value)
+		template, _ := json.Marshal(templates[value])
+		pairs = append(pairs, string(quoted), string(template))
+	}
+	return strings.NewReplacer(pairs...).Replace(data)
+}
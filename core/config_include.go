@@ -0,0 +1,178 @@
+package core
+
+//include指令：把其他配置文件拼接进当前解析
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 配置文件的读取状态
+type configReader struct {
+	stack []string //正在解析的文件（绝对路径），用于检测循环包含
+	files []string //配置依赖的所有文件，包括include进来的文件和引用的密钥文件
+	globs []string //include使用的glob，匹配到的文件增减时需要重新加载
+	raw   bool     //不替换环境变量，用于格式转换
+	//替换过变量的值 -> 原始写法
+	templates map[string]string
+}
+
+// 进入一个配置文件，from为include所在位置，根文件为空
+func (reader *configReader) enter(fileName string, from srcPos) ([]byte, error) {
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", from, err)
+	}
+	for i, f := range reader.stack {
+		if f == abs {
+			chain := append(append([]string{}, reader.stack[i:]...), abs)
+			return nil, fmt.Errorf("%s: include cycle detected: %s", from, strings.Join(chain, " -> "))
+		}
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		if from.file == "" {
+			return nil, fmt.Errorf("open config file failed: %v", err)
+		}
+		return nil, fmt.Errorf("%s: include: %v", from, err)
+	}
+	reader.stack = append(reader.stack, abs)
+	reader.addFile(abs)
+	return data, nil
+}
+
+// 记录配置依赖的文件
+func (reader *configReader) addFile(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	for _, f := range reader.files {
+		if f == path {
+			return
+		}
+	}
+	reader.files = append(reader.files, path)
+}
+
+func (reader *configReader) leave() {
+	reader.stack = reader.stack[:len(reader.stack)-1]
+}
+
+// 展开include的文件列表。相对路径基于包含它的文件所在目录，支持glob，glob没有匹配时不报错
+func (reader *configReader) resolve(pattern string, from srcPos) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(from.file), pattern)
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: include %q: %v", from, pattern, err)
+	}
+	reader.globs = append(reader.globs, pattern)
+	return files, nil
+}
+
+// 展开nginx风格配置中的include指令，可以出现在任意层级
+func (reader *configReader) expandDirectives(dirs []*directive) ([]*directive, error) {
+	var expanded []*directive
+	for _, d := range dirs {
+		if d.name != constant.DIRECTIVE_INCLUDE {
+			if d.hasBlock {
+				block, err := reader.expandDirectives(d.block)
+				if err != nil {
+					return nil, err
+				}
+				d.block = block
+			}
+			expanded = append(expanded, d)
+			continue
+		}
+		if d.hasBlock || len(d.args) != 1 {
+			return nil, d.errorf("directive %q takes 1 argument", d.name)
+		}
+		files, err := reader.resolve(d.args[0], d.srcPos)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := reader.enter(file, d.srcPos)
+			if err != nil {
+				return nil, err
+			}
+			sub, err := reader.parseNginxFile(file, data)
+			if err != nil {
+				return nil, err
+			}
+			reader.leave()
+			expanded = append(expanded, sub...)
+		}
+	}
+	return expanded, nil
+}
+
+// 解析一个nginx风格的文件，并展开其中的include
+func (reader *configReader) parseNginxFile(fileName string, data []byte) ([]*directive, error) {
+	tokens, err := tokenize(fileName, data)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := parseDirectives(fileName, tokens)
+	if err != nil {
+		return nil, err
+	}
+	return reader.expandDirectives(dirs)
+}
+
+// [server]风格配置中的一行
+type cfgLine struct {
+	text string
+	pos  srcPos
+}
+
+// 读取[server]风格的文件，展开"include 路径"行
+func (reader *configReader) readCfgLines(fileName string, data []byte) ([]cfgLine, error) {
+	var lines []cfgLine
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineNum++
+		pos := srcPos{file: fileName, line: lineNum}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != constant.BLOCK_INCLUDE {
+			lines = append(lines, cfgLine{text: line, pos: pos})
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: %s takes 1 argument", pos, constant.BLOCK_INCLUDE)
+		}
+		files, err := reader.resolve(fields[1], pos)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := reader.enter(file, pos)
+			if err != nil {
+				return nil, err
+			}
+			sub, err := reader.readCfgLines(file, data)
+			if err != nil {
+				return nil, err
+			}
+			reader.leave()
+			lines = append(lines, sub...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return lines, nil
+}
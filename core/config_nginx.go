@@ -0,0 +1,348 @@
+package core
+
+//解析nginx风格（花括号）的配置文件
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 词法单元
+type token struct {
+	text   string
+	line   int
+	quoted bool //是否为引号包裹的字符串，引号内的"{"、"}"、";"不作为符号处理
+}
+
+// 指令，例如"listen 80;"或者"server { ... }"
+type directive struct {
+	name     string
+	args     []string
+	block    []*directive //花括号内的子指令
+	hasBlock bool
+	srcPos
+}
+
+// 配置错误，带文件名和行号
+func (d *directive) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s", d.srcPos, fmt.Sprintf(format, args...))
+}
+
+// 词法分析
+func tokenize(fileName string, data []byte) ([]token, error) {
+	var tokens []token
+	src := []rune(string(data))
+	line := 1
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '#':
+			//注释直到行尾
+			for i+1 < len(src) && src[i+1] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, token{text: string(c), line: line})
+		case c == '"' || c == '\'':
+			start := line
+			var sb strings.Builder
+			closed := false
+			for i++; i < len(src); i++ {
+				if src[i] == c {
+					closed = true
+					break
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				if src[i] == '\n' {
+					line++
+				}
+				sb.WriteRune(src[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("%s:%d: unterminated string", fileName, start)
+			}
+			tokens = append(tokens, token{text: sb.String(), line: start, quoted: true})
+		default:
+			var sb strings.Builder
+			for ; i < len(src); i++ {
+				r := src[i]
+				//"${VAR}"中的花括号属于变量，不是块
+				if r == '$' && i+1 < len(src) && src[i+1] == '{' {
+					for ; i < len(src) && src[i] != '}' && src[i] != '\n'; i++ {
+						sb.WriteRune(src[i])
+					}
+					if i == len(src) || src[i] == '\n' {
+						return nil, fmt.Errorf("%s:%d: unterminated \"${\"", fileName, line)
+					}
+					sb.WriteRune('}')
+					continue
+				}
+				if r == ' ' || r == '\t' || r == '\r' || r == '\n' || r == '{' || r == '}' || r == ';' || r == '#' {
+					i--
+					break
+				}
+				sb.WriteRune(r)
+			}
+			tokens = append(tokens, token{text: sb.String(), line: line})
+		}
+	}
+	return tokens, nil
+}
+
+// 语法分析，将词法单元组织成指令树
+func parseDirectives(fileName string, tokens []token) ([]*directive, error) {
+	pos := 0
+	dirs, err := parseBlock(fileName, tokens, &pos, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// parent为花括号所属的指令，顶层为nil
+func parseBlock(fileName string, tokens []token, pos *int, parent *directive) ([]*directive, error) {
+	var dirs []*directive
+	for *pos < len(tokens) {
+		tok := tokens[*pos]
+		if !tok.quoted && tok.text == "}" {
+			if parent == nil {
+				return nil, fmt.Errorf("%s:%d: unexpected \"}\"", fileName, tok.line)
+			}
+			*pos++
+			return dirs, nil
+		}
+		if !tok.quoted && (tok.text == "{" || tok.text == ";") {
+			return nil, fmt.Errorf("%s:%d: unexpected %q", fileName, tok.line, tok.text)
+		}
+		d := &directive{name: tok.text, srcPos: srcPos{file: fileName, line: tok.line}}
+		*pos++
+		terminated := false
+		for *pos < len(tokens) {
+			tok = tokens[*pos]
+			*pos++
+			if !tok.quoted && tok.text == ";" {
+				terminated = true
+				break
+			}
+			if !tok.quoted && tok.text == "{" {
+				block, err := parseBlock(fileName, tokens, pos, d)
+				if err != nil {
+					return nil, err
+				}
+				d.block = block
+				d.hasBlock = true
+				terminated = true
+				break
+			}
+			if !tok.quoted && tok.text == "}" {
+				return nil, d.errorf("directive %q is not terminated by \";\"", d.name)
+			}
+			d.args = append(d.args, tok.text)
+		}
+		if !terminated {
+			return nil, d.errorf("unexpected end of file, expecting \";\" or \"{\"")
+		}
+		dirs = append(dirs, d)
+	}
+	if parent != nil {
+		return nil, parent.errorf("block %q is not closed, unexpected end of file, expecting \"}\"", parent.name)
+	}
+	return dirs, nil
+}
+
+// 解析nginx风格的配置，生成与[server]风格相同的config结构
+func parseNginxConfig(fileName string, data []byte, reader *configReader) (config, error) {
+	var cfg config
+	var errs configErrors
+	cfg.Upstream = make(map[string]*upstream)
+	dirs, err := reader.parseNginxFile(fileName, data)
+	if err != nil {
+		return cfg, err
+	}
+	reader.expandArgs(dirs, &errs)
+	//proxy_pass中携带的协议，upstream未设置scheme时使用
+	proxySchemes := make(map[string]string)
+	for _, d := range dirs {
+		switch d.name {
+		case constant.DIRECTIVE_SERVER:
+			if !expectBlock(d, 0, &errs) {
+				continue
+			}
+			cfg.Service = append(cfg.Service, nginxService(d, proxySchemes, &errs))
+		case constant.DIRECTIVE_UPSTREAM:
+			if !expectBlock(d, 1, &errs) {
+				continue
+			}
+			if _, ok := cfg.Upstream[d.args[0]]; ok {
+				errs.add(d.srcPos, "duplicate upstream %q", d.args[0])
+				continue
+			}
+			cfg.Upstream[d.args[0]] = nginxUpstream(d, d.args[0], &errs)
+		case constant.DIRECTIVE_UPSTREAM_DEFAULT:
+			if !expectBlock(d, 0, &errs) {
+				continue
+			}
+			if cfg.UpstreamDefault != nil {
+				errs.add(d.srcPos, "duplicate %s", d.name)
+				continue
+			}
+			cfg.UpstreamDefault = nginxUpstream(d, "", &errs)
+		default:
+			errs.add(d.srcPos, "unknown directive %q", d.name)
+		}
+	}
+	for name, scheme := range proxySchemes {
+		if u, ok := cfg.Upstream[name]; ok && u.Scheme == "" {
+			u.Scheme = scheme
+		}
+	}
+	return cfg, errs.err()
+}
+
+// 替换所有指令参数中的环境变量
+func (reader *configReader) expandArgs(dirs []*directive, errs *configErrors) {
+	for _, d := range dirs {
+		for i, arg := range d.args {
+			d.args[i] = reader.expandValue(arg, d.srcPos, errs)
+		}
+		reader.expandArgs(d.block, errs)
+	}
+}
+
+// server块
+func nginxService(d *directive, proxySchemes map[string]string, errs *configErrors) *service {
+	s := &service{pos: d.srcPos}
+	for _, sub := range d.block {
+		switch sub.name {
+		case constant.DIRECTIVE_LISTEN:
+			if !expectArgs(sub, 1, errs) {
+				continue
+			}
+			port := sub.args[0]
+			if strings.Contains(port, ":") {
+				host, p, err := net.SplitHostPort(port)
+				if err != nil {
+					errs.add(sub.srcPos, "invalid listen address %q", port)
+					continue
+				}
+				//service总是监听所有网卡，指定了其他地址时报错，避免本想只监听本机的站点被暴露
+				switch host {
+				case "", "*", "0.0.0.0", "::":
+				default:
+					errs.add(sub.srcPos, "listen address %q is not supported, server always listens on all interfaces, use \"listen %s;\"", port, p)
+					continue
+				}
+				port = p
+			}
+			s.Port = port
+		case constant.DIRECTIVE_LOCATION:
+			if !expectBlock(sub, 1, errs) {
+				continue
+			}
+			s.Location = append(s.Location, nginxLocation(sub, proxySchemes, errs))
+		default:
+			errs.add(sub.srcPos, "unknown directive %q in server", sub.name)
+		}
+	}
+	return s
+}
+
+// location块
+func nginxLocation(d *directive, proxySchemes map[string]string, errs *configErrors) *location {
+	l := &location{Root: d.args[0], pos: d.srcPos}
+	for _, sub := range d.block {
+		switch sub.name {
+		case constant.DIRECTIVE_PROXY_PASS:
+			if !expectArgs(sub, 1, errs) {
+				continue
+			}
+			target := sub.args[0]
+			if i := strings.Index(target, "://"); i >= 0 {
+				proxySchemes[target[i+3:]] = target[:i]
+				target = target[i+3:]
+			}
+			l.LocationType = constant.LOCATION_LOADBALANCING
+			l.Upstream = target
+			l.upstreamPos = sub.srcPos
+		case constant.DIRECTIVE_FILE_ROOT:
+			if !expectArgs(sub, 1, errs) {
+				continue
+			}
+			l.LocationType = constant.LOCATION_FILESERVICE
+			l.FileRoot = sub.args[0]
+		default:
+			errs.add(sub.srcPos, "unknown directive %q in location", sub.name)
+		}
+	}
+	return l
+}
+
+// upstream块，name为空时为upstream_default块
+func nginxUpstream(d *directive, name string, errs *configErrors) *upstream {
+	u := &upstream{name: name, pos: d.srcPos}
+	for _, sub := range d.block {
+		switch sub.name {
+		case constant.DIRECTIVE_SERVER:
+			if name == "" {
+				errs.add(sub.srcPos, "directive %q is not allowed in %s", sub.name, d.name)
+				continue
+			}
+			//"server 地址 属性...;"
+			if sub.hasBlock || len(sub.args) == 0 {
+				errs.add(sub.srcPos, "directive %q takes an address and optional attributes", sub.name)
+				continue
+			}
+			u.Addr = append(u.Addr, strings.Join(sub.args, " "))
+			u.addrPos = append(u.addrPos, sub.srcPos)
+		case constant.DIRECTIVE_PROXY_SET_HEADER:
+			if !expectArgs(sub, 2, errs) {
+				continue
+			}
+			u.ProxySetHeader = append(u.ProxySetHeader, &proxySetHeader{HeaderName: sub.args[0], HeaderValue: sub.args[1]})
+		default:
+			//多个参数的配置项，例如"proxy_next_upstream error timeout;"，参数用空格连接
+			if sub.hasBlock || len(sub.args) == 0 {
+				errs.add(sub.srcPos, "directive %q takes at least 1 argument", sub.name)
+				continue
+			}
+			if err := u.setOption(sub.name, strings.Join(sub.args, " ")); err != nil {
+				errs.add(sub.srcPos, "%v", err)
+			}
+		}
+	}
+	return u
+}
+
+// 检查指令参数个数，且不能带花括号
+func expectArgs(d *directive, n int, errs *configErrors) bool {
+	if d.hasBlock {
+		errs.add(d.srcPos, "directive %q does not take a block", d.name)
+		return false
+	}
+	if len(d.args) != n {
+		errs.add(d.srcPos, "directive %q takes %d argument(s), got %d", d.name, n, len(d.args))
+		return false
+	}
+	return true
+}
+
+// 检查块指令参数个数
+func expectBlock(d *directive, n int, errs *configErrors) bool {
+	if !d.hasBlock {
+		errs.add(d.srcPos, "directive %q requires a block", d.name)
+		return false
+	}
+	if len(d.args) != n {
+		errs.add(d.srcPos, "directive %q takes %d argument(s), got %d", d.name, n, len(d.args))
+		return false
+	}
+	return true
+}
@@ -1,9 +1,446 @@
 package core
 
 import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestConfig(t *testing.T) {
 	readConfigFromFile("../configs/config.cfg")
 }
+
+func writeTestConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNginxDialect(t *testing.T) {
+	cfgFile := writeTestConfig(t, "nginx.cfg", `[server]
+port=80
+[location]
+type=1
+root=/
+upstream=pool1
+[end]
+[end]
+[upstream]
+name=pool1
+replicas=1
+schema=http
+[proxy_set_header]
+key=X-Token
+value=a=b
+[end]
+127.0.0.1:8080 weight=3
+127.0.0.1:8081 backup
+[end]
+`)
+	confFile := writeTestConfig(t, "nginx.conf", `server {
+    listen 80;
+    location / { proxy_pass http://pool1; }
+}
+upstream pool1 {
+    replicas 1;
+    proxy_set_header X-Token "a=b"; # 注释
+    server 127.0.0.1:8080 weight=3;
+    server 127.0.0.1:8081 backup;
+}
+`)
+	want, err := parseConfigFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseConfigFile(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJson, _ := json.Marshal(want)
+	gotJson, _ := json.Marshal(got)
+	if string(wantJson) != string(gotJson) {
+		t.Fatalf("dialects differ:\n%s\n%s", wantJson, gotJson)
+	}
+}
+
+func TestNginxDialectHeader(t *testing.T) {
+	file := writeTestConfig(t, "site.txt", "# dialect=nginx\nserver { listen 8080; }\n")
+	cfg, err := parseConfigFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Service) != 1 || cfg.Service[0].Port != "8080" {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestNginxDialectErrors(t *testing.T) {
+	cases := map[string]string{
+		"missing brace": "server { listen 80;\n",
+		"extra brace":   "server { listen 80; }\n}\n",
+		"no semicolon":  "server { listen 80 }\n",
+		"unknown":       "server {\n  listen 80;\n  foo bar;\n}\n",
+		"listen host":   "server { listen 127.0.0.1:80; }\n",
+	}
+	for name, content := range cases {
+		file := writeTestConfig(t, "bad.conf", content)
+		if _, err := parseConfigFile(file); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	file := writeTestConfig(t, "bad.cfg", `[server]
+port=80
+[location]
+type=1
+root=/
+upstream=pool2
+foo=bar
+[end]
+[end]
+[server]
+port=80
+[end]
+[upstream]
+127.0.0.1:8080
+127.0.0.1:8081 weight=0
+127.0.0.1:8082 slow
+name=pool1
+replicas=x
+schema=ftp
+policy=fastest
+[end]
+[server]
+port=81
+`)
+	err := CheckConfig(file)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{
+		"bad.cfg:6: upstream \"pool2\" is not defined",
+		"bad.cfg:7: unknown key \"foo\"",
+		"bad.cfg:10: duplicate port 80",
+		"bad.cfg:13: upstream \"pool1\": invalid scheme \"ftp\"",
+		"bad.cfg:15: upstream \"pool1\": backend 127.0.0.1:8081: invalid weight \"0\"",
+		"bad.cfg:16: upstream \"pool1\": backend 127.0.0.1:8082: unknown attribute \"slow\"",
+		"bad.cfg:18: replicas",
+		"bad.cfg:20: unknown policy \"fastest\"",
+		"bad.cfg:22: [server] is not closed",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+	//nginx风格中后端服务器的错误定位到所在行
+	file = writeTestConfig(t, "bad.conf", "upstream pool1 {\n    server 127.0.0.1:8080;\n    server 127.0.0.1:8080;\n    server 127.0.0.1:8081 max_fails=x;\n}\n")
+	err = CheckConfig(file)
+	for _, want := range []string{"bad.conf:3: upstream \"pool1\": duplicate backend", "bad.conf:4: upstream \"pool1\": backend 127.0.0.1:8081"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+	if err := CheckConfig("../configs/config.cfg"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExplicitZeroReplicas(t *testing.T) {
+	cases := map[string]string{
+		"zero.cfg":  "[server]\nport=80\n[location]\ntype=1\nupstream=pool1\n[end]\n[end]\n[upstream]\n127.0.0.1:8080\nname=pool1\nreplicas=0\n[end]\n",
+		"zero.json": `{"service":[{"port":"80","location":[{"type":1,"upstream":"pool1"}]}],"upstream":{"pool1":{"addr":["127.0.0.1:8080"],"replicas":0}}}`,
+	}
+	for name, content := range cases {
+		err := CheckConfig(writeTestConfig(t, name, content))
+		if err == nil || !strings.Contains(err.Error(), name+":") || !strings.Contains(err.Error(), "invalid replicas 0") {
+			t.Errorf("%s: expected invalid replicas with position, got %v", name, err)
+		}
+	}
+	//没有设置时使用默认值1
+	file := writeTestConfig(t, "unset.json", `{"service":[{"port":"80","location":[{"type":1,"upstream":"pool1"}]}],"upstream":{"pool1":{"addr":["127.0.0.1:8080"]}}}`)
+	if err := CheckConfig(file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("conf.d/a.cfg", "[server]\nport=80\n[location]\ntype=1\nupstream=pool1\n[end]\n[end]\n")
+	write("conf.d/b.cfg", "[server]\nport=81\n[location]\ntype=1\nupstream=pool1\n[end]\n[end]\n")
+	write("upstream.cfg", "[upstream]\nname=pool1\n127.0.0.1:8080\n[end]\n")
+	main := write("main.cfg", "include conf.d/*.cfg\ninclude upstream.cfg\n")
+	cfg, err := loadConfig(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Service) != 2 || cfg.Service[1].Port != "81" || cfg.Upstream["pool1"] == nil || len(cfg.files) != 4 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	write("conf.d/b.cfg", "[server]\nport=81\nfoo=bar\n[end]\n")
+	_, err = loadConfig(main)
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "conf.d/b.cfg")+":3") {
+		t.Fatalf("error should name the included file: %v", err)
+	}
+
+	write("loop.conf", "include loop2.conf;\n")
+	write("loop2.conf", "server { include loop.conf; }\n")
+	_, err = loadConfig(filepath.Join(dir, "loop.conf"))
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expected include cycle error, got %v", err)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	secret := writeTestConfig(t, "secret", "s3cret\n")
+	t.Setenv("NGINXGO_PORT", "8080")
+	t.Setenv("NGINXGO_EMPTY", "")
+	cases := map[string]string{
+		"${NGINXGO_PORT}":               "8080",
+		"127.0.0.1:${NGINXGO_PORT}":     "127.0.0.1:8080",
+		"${NGINXGO_UNSET_VAR:-80}":      "80",
+		"${NGINXGO_EMPTY:-x}":           "x",
+		"Bearer ${file:" + secret + "}": "Bearer s3cret",
+		"$$HOME":                        "$HOME",
+		"a=b":                           "a=b",
+	}
+	for in, want := range cases {
+		got, err := interpolate(in, nil)
+		if err != nil || got != want {
+			t.Errorf("interpolate(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"${NGINXGO_UNSET_VAR}", "${NGINXGO_PORT", "${file:/nonexistent}"} {
+		if _, err := interpolate(in, nil); err == nil {
+			t.Errorf("interpolate(%q) should fail", in)
+		}
+	}
+
+	file := writeTestConfig(t, "env.conf", "server {\n  listen ${NGINXGO_PORT};\n  location / { proxy_pass http://pool1; }\n}\nupstream pool1 {\n  server ${NGINXGO_BACKEND};\n}\n")
+	err := CheckConfig(file)
+	if err == nil || !strings.Contains(err.Error(), "env.conf:6: environment variable \"NGINXGO_BACKEND\" is not set") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Setenv("NGINXGO_BACKEND", "127.0.0.1:9000")
+	cfg, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Service[0].Port != "8080" || cfg.Upstream["pool1"].Addr[0] != "127.0.0.1:9000" {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestConvertConfig(t *testing.T) {
+	dir := t.TempDir()
+	src := "../configs/config.cfg.example"
+	want, err := (&configReader{raw: true}).parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJson, _ := json.Marshal(want)
+	prev := src
+	for _, name := range []string{"a.json", "b.yaml", "c.cfg", "d.yml", "e.conf", "f.cfg"} {
+		dst := filepath.Join(dir, name)
+		if err := ConvertConfig(prev, dst); err != nil {
+			t.Fatalf("%s -> %s: %v", prev, dst, err)
+		}
+		got, err := (&configReader{raw: true}).parse(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotJson, _ := json.Marshal(got)
+		if string(gotJson) != string(wantJson) {
+			t.Fatalf("%s is not lossless:\n%s\n%s", name, wantJson, gotJson)
+		}
+		prev = dst
+	}
+}
+
+func TestJsonConfig(t *testing.T) {
+	t.Setenv("NGINXGO_BACKEND", "127.0.0.1:9000")
+	t.Setenv("NGINXGO_HEALTH", "/healthz")
+	file := writeTestConfig(t, "nginxgo.json", `{"service":[{"port":"80","location":[{"type":1,"root":"/","upstream":"pool1"}]}],
+"upstream":{"pool1":{"addr":["${NGINXGO_BACKEND}"],"replicas":2,"scheme":"http","hash_key":"$uri:${NGINXGO_HEALTH}","health_check":{"path":"${NGINXGO_HEALTH}"}}}}`)
+	cfg, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool1 := cfg.Upstream["pool1"]
+	if pool1.Addr[0] != "127.0.0.1:9000" || pool1.name != "pool1" || pool1.HashKey != "$uri:/healthz" || pool1.HealthCheck.Path != "/healthz" {
+		t.Fatalf("unexpected config: %+v", pool1)
+	}
+	file = writeTestConfig(t, "policy.json", `{"service":[{"port":"80","location":[{"type":1,"root":"/","upstream":"pool1"}]}],
+"upstream":{"pool1":{"addr":["127.0.0.1:9000"],"policy":"fastest"}}}`)
+	if _, err := loadConfig(file); err == nil || !strings.Contains(err.Error(), "unknown policy") {
+		t.Fatalf("expected unknown policy error, got %v", err)
+	}
+	file = writeTestConfig(t, "negative.json", `{"service":[{"port":"80","location":[{"type":1,"root":"/","upstream":"pool1"}]}],
+"upstream":{"pool1":{"addr":["127.0.0.1:9000"],"health_check":{"path":"/h","interval":"-1s"}}}}`)
+	if _, err := loadConfig(file); err == nil || !strings.Contains(err.Error(), "invalid duration \"-1s\"") {
+		t.Fatalf("expected invalid duration error, got %v", err)
+	}
+	file = writeTestConfig(t, "bad.json", "{\n\"service\": [,]\n}")
+	if _, err := loadConfig(file); err == nil || !strings.Contains(err.Error(), "bad.json:2") {
+		t.Fatalf("expected line number in error, got %v", err)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	parse := func(content string) config {
+		cfg, err := loadConfig(writeTestConfig(t, "diff.conf", content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	old := parse(`server { listen 80; location / { proxy_pass http://pool1; } }
+server { listen 81; location / { proxy_pass http://pool2; } }
+upstream pool1 { server 127.0.0.1:8080; server 127.0.0.1:8081; }
+upstream pool2 { server 127.0.0.1:9090; }
+upstream pool3 { server 127.0.0.1:7070; }
+`)
+	new := parse(`server { listen 80; location / { proxy_pass http://pool1; } }
+server { listen 81; location / { proxy_pass http://pool1; } location /a { file_root ./a; } }
+server { listen 82; location / { proxy_pass http://pool2; } }
+upstream pool1 { server 127.0.0.1:8080; server 127.0.0.1:8082; proxy_set_header X-A b; }
+upstream pool2 { server 127.0.0.1:9090; }
+upstream pool4 { server 127.0.0.1:6060; }
+`)
+	diff := diffConfig(old, new)
+	if !diff.addedServices["82"] || !diff.changedServices["81"] || diff.changedServices["80"] {
+		t.Fatalf("unexpected service diff: %+v", diff)
+	}
+	if !diff.changedUpstreams["pool1"] || diff.changedUpstreams["pool2"] || !diff.addedUpstreams["pool4"] || !diff.removedUpstreams["pool3"] {
+		t.Fatalf("unexpected upstream diff: %+v", diff)
+	}
+	for _, want := range []string{
+		"server :81: location /: upstream: \"pool2\" -> \"pool1\"",
+		"server :81: location /a added",
+		"upstream pool1: backend 127.0.0.1:8082 added",
+		"upstream pool1: backend 127.0.0.1:8081 removed",
+		"upstream pool1: proxy_set_header:",
+	} {
+		if !strings.Contains(diff.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, diff)
+		}
+	}
+	if diff := diffConfig(old, old); !diff.empty() {
+		t.Fatalf("expected no changes, got:\n%s", diff)
+	}
+}
+
+func TestSecretsNotLogged(t *testing.T) {
+	secret := writeTestConfig(t, "token", "s3cret-old\n")
+	content := "upstream pool1 {\n  server 127.0.0.1:8080;\n  proxy_set_header X-Token ${file:" + secret + "};\n}\n"
+	old, err := loadConfig(writeTestConfig(t, "a.conf", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(secret, []byte("s3cret-new\n"), 0600)
+	new, err := loadConfig(writeTestConfig(t, "b.conf", content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := diffConfig(old, new)
+	if !diff.changedUpstreams["pool1"] {
+		t.Fatalf("secret change should be detected: %+v", diff)
+	}
+	data, _ := json.Marshal(new)
+	for _, text := range []string{diff.String(), unexpand(string(data), new.templates)} {
+		if strings.Contains(text, "s3cret") || !strings.Contains(text, "${file:") {
+			t.Errorf("secret leaked into log text:\n%s", text)
+		}
+	}
+}
+
+func TestStickySecretNotLogged(t *testing.T) {
+	parse := func(secret string) config {
+		cfg, err := loadConfig(writeTestConfig(t, "sticky.conf", "upstream pool1 {\n  server 127.0.0.1:8080;\n  sticky cookie route;\n  sticky_secret "+secret+";\n}\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	old, new := parse("key-old"), parse("key-new")
+	diff := diffConfig(old, new)
+	if !diff.changedUpstreams["pool1"] {
+		t.Fatalf("secret change should be detected: %+v", diff)
+	}
+	data, _ := json.Marshal(new)
+	for _, text := range []string{diff.String(), unexpand(string(data), logTemplates(new))} {
+		if strings.Contains(text, "key-") {
+			t.Errorf("sticky secret leaked into log text:\n%s", text)
+		}
+	}
+}
+
+func TestUpstreamDefault(t *testing.T) {
+	for name, content := range map[string]string{
+		"defaults.cfg": `[upstream]
+127.0.0.1:8080
+replicas=3
+name=pool1
+[proxy_set_header]
+key=x-a
+value=pool
+[end]
+[end]
+[upstream_default]
+schema=https
+replicas=2
+connect_timeout=1s
+[proxy_set_header]
+key=X-A
+value=default
+[end]
+[proxy_set_header]
+key=X-B
+value=default
+[end]
+[end]
+[upstream]
+name=pool2
+127.0.0.1:8081
+[end]
+`,
+		"defaults.conf": `upstream pool1 { server 127.0.0.1:8080; replicas 3; proxy_set_header x-a pool; }
+upstream_default {
+    scheme https;
+    replicas 2;
+    connect_timeout 1s;
+    proxy_set_header X-A default;
+    proxy_set_header X-B default;
+}
+upstream pool2 { server 127.0.0.1:8081; }
+`} {
+		cfg, err := loadConfig(writeTestConfig(t, name, content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool1, pool2 := cfg.Upstream["pool1"], cfg.Upstream["pool2"]
+		if pool1.Replicas != 3 || pool2.Replicas != 2 || pool1.Scheme != "https" || pool2.ConnectTimeout.String() != "1s" {
+			t.Fatalf("%s: unexpected upstreams: %+v %+v", name, pool1, pool2)
+		}
+		if len(pool1.ProxySetHeader) != 2 || pool1.ProxySetHeader[0].HeaderName != "X-B" || pool1.ProxySetHeader[1].HeaderValue != "pool" {
+			t.Fatalf("%s: unexpected headers: %v", name, pool1.ProxySetHeader)
+		}
+		if len(pool2.ProxySetHeader) != 2 {
+			t.Fatalf("%s: unexpected headers: %v", name, pool2.ProxySetHeader)
+		}
+	}
+}
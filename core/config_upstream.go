@@ -0,0 +1,355 @@
+package core
+
+//后端服务器池的配置项，两种方言共用
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 时间间隔，配置中写作"5s"、"100ms"
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	//与parseDuration一致，不允许负数
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = duration(v)
+	return nil
+}
+
+func parseDuration(value string) (duration, error) {
+	v, err := time.ParseDuration(value)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return duration(v), nil
+}
+
+// 设置后端服务器池的配置项，upstream块和upstream默认块共用
+func (upstream *upstream) setOption(key, value string) error {
+	switch key {
+	case constant.BLOCK_UPSTREAM_REPLICAS:
+		replicas, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("replicas 字段设置错误：%q is not a number", value)
+		}
+		upstream.Replicas = replicas
+		upstream.replicasSet = true
+	case constant.BLOCK_UPSTREAM_SCHEMA, constant.DIRECTIVE_SCHEME:
+		upstream.Scheme = value
+	case constant.BLOCK_UPSTREAM_CONNECT_TIMEOUT:
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		upstream.ConnectTimeout = d
+	case constant.BLOCK_UPSTREAM_READ_TIMEOUT:
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		upstream.ReadTimeout = d
+	case constant.BLOCK_UPSTREAM_POLICY:
+		if _, ok := balancers[value]; !ok {
+			return fmt.Errorf("unknown policy %q", value)
+		}
+		upstream.Policy = value
+	case constant.BLOCK_UPSTREAM_HASH_KEY:
+		if _, err := parseHashKey(value); err != nil {
+			return err
+		}
+		upstream.HashKey = value
+	case constant.BLOCK_UPSTREAM_LOAD_FACTOR:
+		loadFactor, err := strconv.ParseFloat(value, 64)
+		if err != nil || loadFactor < 1 {
+			return fmt.Errorf("invalid load_factor %q, must be a number >= 1", value)
+		}
+		upstream.LoadFactor = loadFactor
+	case constant.BLOCK_UPSTREAM_FAIL_STATUS:
+		if _, err := parseStatusRanges(value); err != nil {
+			return err
+		}
+		upstream.FailStatus = value
+	case constant.BLOCK_UPSTREAM_SLOW_START:
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		upstream.SlowStart = d
+	default:
+		if strings.HasPrefix(key, constant.HEALTH_CHECK) {
+			if upstream.HealthCheck == nil {
+				upstream.HealthCheck = &healthCheck{}
+			}
+			return upstream.HealthCheck.setOption(key, value)
+		}
+		if strings.HasPrefix(key, constant.NEXT_UPSTREAM) {
+			if upstream.NextUpstream == nil {
+				upstream.NextUpstream = &nextUpstream{}
+			}
+			return upstream.NextUpstream.setOption(key, value)
+		}
+		if strings.HasPrefix(key, constant.FALLBACK) {
+			if upstream.Fallback == nil {
+				upstream.Fallback = &fallback{}
+			}
+			return upstream.Fallback.setOption(key, value)
+		}
+		if strings.HasPrefix(key, constant.CIRCUIT_BREAKER) {
+			if upstream.CircuitBreaker == nil {
+				upstream.CircuitBreaker = &circuitBreaker{}
+			}
+			return upstream.CircuitBreaker.setOption(key, value)
+		}
+		if strings.HasPrefix(key, constant.STICKY) {
+			if upstream.Sticky == nil {
+				upstream.Sticky = &sticky{}
+			}
+			return upstream.Sticky.setOption(key, value)
+		}
+		if strings.HasPrefix(key, constant.DISCOVERY) {
+			if upstream.Discovery == nil {
+				upstream.Discovery = &discovery{}
+			}
+			return upstream.Discovery.setOption(key, value)
+		}
+		if strings.HasPrefix(key, constant.OUTLIER_DETECTION) {
+			if upstream.OutlierDetection == nil {
+				upstream.OutlierDetection = &outlierDetection{}
+			}
+			return upstream.OutlierDetection.setOption(key, value)
+		}
+		return fmt.Errorf("unknown key %q in upstream", key)
+	}
+	return nil
+}
+
+// 已设置的配置项，用于输出[server]风格的配置
+func (upstream *upstream) options() [][2]string {
+	var options [][2]string
+	add := func(key, value string) {
+		options = append(options, [2]string{key, value})
+	}
+	if upstream.replicasSet || upstream.Replicas != 0 {
+		add(constant.BLOCK_UPSTREAM_REPLICAS, strconv.Itoa(upstream.Replicas))
+	}
+	if upstream.Scheme != "" {
+		add(constant.BLOCK_UPSTREAM_SCHEMA, upstream.Scheme)
+	}
+	if upstream.ConnectTimeout != 0 {
+		add(constant.BLOCK_UPSTREAM_CONNECT_TIMEOUT, upstream.ConnectTimeout.String())
+	}
+	if upstream.ReadTimeout != 0 {
+		add(constant.BLOCK_UPSTREAM_READ_TIMEOUT, upstream.ReadTimeout.String())
+	}
+	if upstream.Policy != "" {
+		add(constant.BLOCK_UPSTREAM_POLICY, upstream.Policy)
+	}
+	if upstream.HashKey != "" {
+		add(constant.BLOCK_UPSTREAM_HASH_KEY, upstream.HashKey)
+	}
+	if upstream.LoadFactor != 0 {
+		add(constant.BLOCK_UPSTREAM_LOAD_FACTOR, strconv.FormatFloat(upstream.LoadFactor, 'g', -1, 64))
+	}
+	if upstream.FailStatus != "" {
+		add(constant.BLOCK_UPSTREAM_FAIL_STATUS, upstream.FailStatus)
+	}
+	if upstream.SlowStart != 0 {
+		add(constant.BLOCK_UPSTREAM_SLOW_START, upstream.SlowStart.String())
+	}
+	if upstream.HealthCheck != nil {
+		options = append(options, upstream.HealthCheck.options()...)
+	}
+	if upstream.NextUpstream != nil {
+		options = append(options, upstream.NextUpstream.options()...)
+	}
+	if upstream.Fallback != nil {
+		options = append(options, upstream.Fallback.options()...)
+	}
+	if upstream.CircuitBreaker != nil {
+		options = append(options, upstream.CircuitBreaker.options()...)
+	}
+	if upstream.OutlierDetection != nil {
+		options = append(options, upstream.OutlierDetection.options()...)
+	}
+	if upstream.Discovery != nil {
+		options = append(options, upstream.Discovery.options()...)
+	}
+	if upstream.Sticky != nil {
+		options = append(options, upstream.Sticky.options()...)
+	}
+	return options
+}
+
+// 按超时配置构建transport，没有配置超时时使用默认transport
+func (upstream *upstream) newTransport() http.RoundTripper {
+	if upstream.ConnectTimeout == 0 && upstream.ReadTimeout == 0 {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if upstream.ConnectTimeout != 0 {
+		dialer := &net.Dialer{
+			Timeout:   time.Duration(upstream.ConnectTimeout),
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	transport.ResponseHeaderTimeout = time.Duration(upstream.ReadTimeout)
+	return transport
+}
+
+// 继承默认块中的配置，后端服务器池自己设置的值优先
+func (upstream *upstream) inherit(defaults *upstream) {
+	if !upstream.replicasSet && upstream.Replicas == 0 {
+		upstream.Replicas = defaults.Replicas
+		upstream.replicasSet = defaults.replicasSet
+	}
+	if upstream.Scheme == "" {
+		upstream.Scheme = defaults.Scheme
+	}
+	if upstream.ConnectTimeout == 0 {
+		upstream.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if upstream.ReadTimeout == 0 {
+		upstream.ReadTimeout = defaults.ReadTimeout
+	}
+	if upstream.Policy == "" {
+		upstream.Policy = defaults.Policy
+	}
+	if upstream.HashKey == "" {
+		upstream.HashKey = defaults.HashKey
+	}
+	if upstream.LoadFactor == 0 {
+		upstream.LoadFactor = defaults.LoadFactor
+	}
+	if upstream.FailStatus == "" {
+		upstream.FailStatus = defaults.FailStatus
+	}
+	if upstream.SlowStart == 0 {
+		upstream.SlowStart = defaults.SlowStart
+	}
+	if upstream.HealthCheck == nil && defaults.HealthCheck != nil {
+		healthCheck := *defaults.HealthCheck
+		upstream.HealthCheck = &healthCheck
+	}
+	if upstream.NextUpstream == nil && defaults.NextUpstream != nil {
+		nextUpstream := *defaults.NextUpstream
+		upstream.NextUpstream = &nextUpstream
+	}
+	if upstream.Fallback == nil && defaults.Fallback != nil {
+		fallback := *defaults.Fallback
+		upstream.Fallback = &fallback
+	}
+	if upstream.CircuitBreaker == nil && defaults.CircuitBreaker != nil {
+		circuitBreaker := *defaults.CircuitBreaker
+		upstream.CircuitBreaker = &circuitBreaker
+	}
+	if upstream.OutlierDetection == nil && defaults.OutlierDetection != nil {
+		outlierDetection := *defaults.OutlierDetection
+		upstream.OutlierDetection = &outlierDetection
+	}
+	if upstream.Sticky == nil && defaults.Sticky != nil {
+		sticky := *defaults.Sticky
+		upstream.Sticky = &sticky
+	}
+	//同名的header以后端服务器池为准
+	overridden := make(map[string]bool)
+	for _, header := range upstream.ProxySetHeader {
+		overridden[http.CanonicalHeaderKey(header.HeaderName)] = true
+	}
+	var headers []*proxySetHeader
+	for _, header := range defaults.ProxySetHeader {
+		if !overridden[http.CanonicalHeaderKey(header.HeaderName)] {
+			newHeader := *header
+			headers = append(headers, &newHeader)
+		}
+	}
+	upstream.ProxySetHeader = append(headers, upstream.ProxySetHeader...)
+}
+
+// 后端服务器，配置中写作"地址 属性..."，例如"127.0.0.1:8080 weight=5 max_fails=3 backup"
+type backend struct {
+	addr        string
+	weight      int
+	maxFails    int
+	failTimeout time.Duration
+	backup      bool
+}
+
+// 解析一行后端服务器配置
+func parseBackend(line string) (backend, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return backend{}, fmt.Errorf("empty backend address")
+	}
+	b := backend{
+		addr:        fields[0],
+		weight:      constant.DEFAULT_BACKEND_WEIGHT,
+		maxFails:    constant.DEFAULT_BACKEND_MAX_FAILS,
+		failTimeout: constant.DEFAULT_BACKEND_FAIL_TIMEOUT,
+	}
+	if _, _, err := net.SplitHostPort(b.addr); err != nil {
+		return b, fmt.Errorf("invalid backend address %q", b.addr)
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case constant.BACKEND_WEIGHT:
+			weight, err := strconv.Atoi(value)
+			if err != nil || weight < 1 {
+				return b, fmt.Errorf("backend %s: invalid weight %q", b.addr, value)
+			}
+			b.weight = weight
+		case constant.BACKEND_MAX_FAILS:
+			maxFails, err := strconv.Atoi(value)
+			if err != nil || maxFails < 0 {
+				return b, fmt.Errorf("backend %s: invalid max_fails %q", b.addr, value)
+			}
+			b.maxFails = maxFails
+		case constant.BACKEND_FAIL_TIMEOUT:
+			d, err := parseDuration(value)
+			if err != nil || d == 0 {
+				return b, fmt.Errorf("backend %s: invalid fail_timeout %q", b.addr, value)
+			}
+			b.failTimeout = time.Duration(d)
+		case constant.BACKEND_BACKUP:
+			if value != "" {
+				return b, fmt.Errorf("backend %s: backup does not take a value", b.addr)
+			}
+			b.backup = true
+		default:
+			return b, fmt.Errorf("backend %s: unknown attribute %q", b.addr, field)
+		}
+	}
+	return b, nil
+}
+
+// 后端服务器地址，去掉属性
+func backendAddr(line string) string {
+	if fields := strings.Fields(line); len(fields) > 0 {
+		return fields[0]
+	}
+	return line
+}
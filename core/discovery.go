@@ -0,0 +1,297 @@
+package core
+
+//服务发现：定期从文件或者DNS获取后端服务器，与静态的后端服务器合并，变化时重构负载均衡器，不需要热重启
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 服务发现配置
+type discovery struct {
+	File       string   `json:"file,omitempty"`       //后端服务器列表文件
+	DNS        string   `json:"dns,omitempty"`        //解析的域名
+	DNSType    string   `json:"dns_type,omitempty"`   //记录类型，默认ip（A和AAAA）
+	DNSServer  string   `json:"dns_server,omitempty"` //DNS服务器地址，不设置时使用系统配置
+	Interval   duration `json:"interval,omitempty"`   //刷新间隔，默认10s
+	Attributes string   `json:"attributes,omitempty"` //附加给每个发现的后端服务器的属性
+}
+
+// 设置服务发现的配置项
+func (d *discovery) setOption(key, value string) error {
+	switch key {
+	case constant.DISCOVERY_FILE:
+		d.File = value
+	case constant.DISCOVERY_DNS:
+		d.DNS = value
+	case constant.DISCOVERY_DNS_TYPE:
+		d.DNSType = value
+	case constant.DISCOVERY_DNS_SERVER:
+		d.DNSServer = value
+	case constant.DISCOVERY_INTERVAL:
+		interval, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		d.Interval = interval
+	case constant.DISCOVERY_ATTRIBUTES:
+		d.Attributes = value
+	default:
+		return fmt.Errorf("unknown key %q in upstream", key)
+	}
+	return nil
+}
+
+// 已设置的配置项，用于输出[server]风格的配置
+func (d *discovery) options() [][2]string {
+	var options [][2]string
+	add := func(key, value string) {
+		if value != "" {
+			options = append(options, [2]string{key, value})
+		}
+	}
+	add(constant.DISCOVERY_FILE, d.File)
+	add(constant.DISCOVERY_DNS, d.DNS)
+	add(constant.DISCOVERY_DNS_TYPE, d.DNSType)
+	add(constant.DISCOVERY_DNS_SERVER, d.DNSServer)
+	if d.Interval != 0 {
+		add(constant.DISCOVERY_INTERVAL, d.Interval.String())
+	}
+	add(constant.DISCOVERY_ATTRIBUTES, d.Attributes)
+	return options
+}
+
+// DNS解析，*net.Resolver实现了这个接口，测试时可以替换
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// 没有设置dns_server时使用的解析器
+var defaultResolver resolver = net.DefaultResolver
+
+// 校验并解析后的服务发现配置
+type discoverer struct {
+	file       string
+	host       string //A/AAAA记录的域名，或者SRV名称
+	port       string //A/AAAA记录使用的端口
+	dnsType    string
+	resolver   resolver
+	interval   time.Duration
+	attributes string
+}
+
+func (d *discovery) compile() (*discoverer, error) {
+	dc := &discoverer{
+		file:       d.File,
+		dnsType:    d.DNSType,
+		interval:   time.Duration(d.Interval),
+		attributes: strings.Join(strings.Fields(d.Attributes), " "),
+	}
+	if d.File == "" && d.DNS == "" {
+		return nil, fmt.Errorf("%s requires %s or %s", constant.DISCOVERY, constant.DISCOVERY_FILE, constant.DISCOVERY_DNS)
+	}
+	if dc.interval == 0 {
+		dc.interval = constant.DEFAULT_DISCOVERY_INTERVAL
+	}
+	//JSON/YAML中的负数也在这里拦住，否则启动时NewTicker会panic
+	if dc.interval < 0 {
+		return nil, fmt.Errorf("invalid %s %v, must be positive", constant.DISCOVERY_INTERVAL, d.Interval)
+	}
+	if dc.dnsType == "" {
+		dc.dnsType = constant.DNS_TYPE_IP
+	}
+	switch dc.dnsType {
+	case constant.DNS_TYPE_IP, constant.DNS_TYPE_A, constant.DNS_TYPE_AAAA:
+		if d.DNS != "" {
+			host, port, err := net.SplitHostPort(d.DNS)
+			if err != nil || host == "" || port == "" {
+				return nil, fmt.Errorf("invalid %s %q, expecting host:port", constant.DISCOVERY_DNS, d.DNS)
+			}
+			dc.host, dc.port = host, port
+		}
+	case constant.DNS_TYPE_SRV:
+		dc.host = d.DNS
+	default:
+		return nil, fmt.Errorf("invalid %s %q", constant.DISCOVERY_DNS_TYPE, d.DNSType)
+	}
+	if dc.attributes != "" {
+		if _, err := parseBackend("127.0.0.1:1 " + dc.attributes); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", constant.DISCOVERY_ATTRIBUTES, err)
+		}
+	}
+	dc.resolver = defaultResolver
+	if d.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(d.DNSServer); err != nil {
+			return nil, fmt.Errorf("invalid %s %q, expecting host:port", constant.DISCOVERY_DNS_SERVER, d.DNSServer)
+		}
+		server := d.DNSServer
+		dc.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return dc, nil
+}
+
+// 获取一次后端服务器列表，文件和DNS都设置时合并
+func (dc *discoverer) discover(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, constant.DISCOVERY_TIMEOUT)
+	defer cancel()
+	var lines []string
+	if dc.file != "" {
+		fileLines, err := readBackendFile(dc.file)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, fileLines...)
+	}
+	if dc.host != "" {
+		dnsLines, err := dc.lookup(ctx)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, dnsLines...)
+	}
+	if dc.attributes != "" {
+		for i, line := range lines {
+			lines[i] = line + " " + dc.attributes
+		}
+	}
+	return lines, nil
+}
+
+// 读取后端服务器列表文件：JSON字符串数组，或者每行一个，"#"开头的行为注释
+func readBackendFile(fileName string) ([]string, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &lines); err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	for i, line := range lines {
+		if _, err := parseBackend(line); err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return lines, nil
+}
+
+// DNS解析，结果按地址排序，避免记录顺序变化导致重建
+func (dc *discoverer) lookup(ctx context.Context) ([]string, error) {
+	var lines []string
+	if dc.dnsType == constant.DNS_TYPE_SRV {
+		_, records, err := dc.resolver.LookupSRV(ctx, "", "", dc.host)
+		if err != nil {
+			return nil, err
+		}
+		//优先级最高（数值最小）的为主服务器，其余为备用服务器
+		priority := -1
+		for _, r := range records {
+			if priority < 0 || int(r.Priority) < priority {
+				priority = int(r.Priority)
+			}
+		}
+		for _, r := range records {
+			line := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+			if r.Weight > 1 {
+				line += " " + constant.BACKEND_WEIGHT + "=" + strconv.Itoa(int(r.Weight))
+			}
+			if int(r.Priority) != priority {
+				line += " " + constant.BACKEND_BACKUP
+			}
+			lines = append(lines, line)
+		}
+	} else {
+		addrs, err := dc.resolver.LookupIPAddr(ctx, dc.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipv4 := addr.IP.To4() != nil
+			if dc.dnsType == constant.DNS_TYPE_A && !ipv4 || dc.dnsType == constant.DNS_TYPE_AAAA && ipv4 {
+				continue
+			}
+			lines = append(lines, net.JoinHostPort(addr.IP.String(), dc.port))
+		}
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("no %s records for %s", dc.dnsType, dc.host)
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// 刷新一次，列表变化时重构负载均衡器。失败时保留原来的列表
+func (upstream *upstream) refresh(ctx context.Context, dc *discoverer) {
+	lines, err := dc.discover(ctx)
+	if err != nil {
+		//停止时的取消不算失败
+		if ctx.Err() == nil {
+			logger.Error("后端服务器池", upstream.name, "服务发现失败，沿用原来的后端服务器:", err)
+		}
+		return
+	}
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if strings.Join(lines, "\n") == strings.Join(upstream.discovered, "\n") {
+		return
+	}
+	logger.Info("后端服务器池", upstream.name, "服务发现的后端服务器变为", lines)
+	upstream.discovered = lines
+	upstream.rebuild()
+}
+
+// 每个间隔刷新一次
+func (upstream *upstream) discoveryLoop(ctx context.Context, dc *discoverer) {
+	ticker := time.NewTicker(dc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			upstream.refresh(ctx, dc)
+		}
+	}
+}
+
+// 参与负载均衡的后端服务器：静态的后端服务器加上服务发现的，地址相同时以静态的为准。调用方需持有upstream.mu
+func (upstream *upstream) members() []string {
+	if len(upstream.discovered) == 0 {
+		return upstream.Addr
+	}
+	lines := append([]string{}, upstream.Addr...)
+	for _, line := range upstream.discovered {
+		if indexBackend(upstream.Addr, backendAddr(line)) < 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
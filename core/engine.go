@@ -3,8 +3,10 @@ package core
 //引擎控制
 
 import (
-	"strconv"
+	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/hellobchain/nginxgo/common/constant"
 	"github.com/hellobchain/nginxgo/common/log"
@@ -16,90 +18,233 @@ var logger = wlogging.MustGetFileLoggerWithoutName(log.LogConfig)
 
 // 引擎
 type Engine struct {
-	service           []service
-	upstream          map[string]*upstream
-	servicesPoll      map[string]*service //现有的服务池
-	resetServicesPoll map[string]*service //重启后的服务池
-	state             int                 //引擎现在的状态
-	wg                sync.WaitGroup
+	service      []*service
+	upstream     upstreamTable       //当前生效的后端服务器池
+	servicesPoll map[string]*service //现有的服务池
+	state        int                 //引擎现在的状态
+	mu           sync.Mutex          //一把锁，保证同一时间只有一个重启
+	done         chan struct{}       //引擎停止时关闭，通知后台任务退出
+	watchers     sync.WaitGroup      //监听配置文件的后台任务，停止时等待退出
+	templates    map[string]string   //当前配置中替换过变量的值，输出日志时还原
+}
+
+// 后端服务器池表，热重启时整体原子替换，处理中的请求不受影响
+type upstreamTable struct {
+	pools atomic.Pointer[map[string]*upstream]
+}
+
+func (table *upstreamTable) get(name string) *upstream {
+	pools := table.pools.Load()
+	if pools == nil {
+		return nil
+	}
+	return (*pools)[name]
+}
+
+func (table *upstreamTable) all() map[string]*upstream {
+	pools := table.pools.Load()
+	if pools == nil {
+		return nil
+	}
+	return *pools
+}
+
+func (table *upstreamTable) store(pools map[string]*upstream) {
+	table.pools.Store(&pools)
 }
 
 func createEngine() *Engine {
 	engine := Engine{}
-	engine.resetServicesPoll = make(map[string]*service)
 	engine.servicesPoll = make(map[string]*service)
+	engine.done = make(chan struct{})
+	engine.state = constant.ENGINE_START
 	return &engine
 }
 
-func (engine *Engine) writeEngine(cfg config) {
-	engine.service = cfg.Service
-	engine.upstream = cfg.Upstream
-
-	//处理后端服务器池，建构哈希环
-	for _, v := range engine.upstream {
-		v.mu.Lock()
-		v.hashRing = &hashRing{}
-		v.hashRing.nodes = make(map[int]string)
-		v.addNode()
-		v.mu.Unlock()
-	}
-
-	//处理服务节点
-	for i := range engine.service {
-		service := &engine.service[i]
-		for _, location := range service.Location {
-			//计算location哈希值，用于一致性比对
-			location.hashValue = hash([]byte(strconv.Itoa(location.LocationType) + location.Root + location.FileRoot + location.Upstream))
-			service.hashValue += uint64(location.hashValue)
-		}
-		if engine.state == constant.ENGINE_RESET { //reset信息写入reset map
-			engine.resetServicesPoll[service.Port] = service
+// 处理后端服务器池，建构负载均衡器和transport
+func (upstream *upstream) prepare() {
+	upstream.transport = upstream.newTransport()
+	upstream.hashKey, _ = parseHashKey(upstream.HashKey)
+	upstream.retry, _ = upstream.NextUpstream.compile()
+	upstream.breaker = nil
+	if upstream.CircuitBreaker != nil {
+		upstream.breaker, _ = upstream.CircuitBreaker.compile()
+	}
+	upstream.outlier = nil
+	if upstream.OutlierDetection != nil {
+		upstream.outlier, _ = upstream.OutlierDetection.compile()
+	}
+	upstream.failStatus = nil
+	if upstream.FailStatus != "" {
+		upstream.failStatus, _ = parseStatusRanges(upstream.FailStatus)
+	}
+	upstream.sticky = nil
+	if upstream.Sticky != nil {
+		upstream.sticky, _ = upstream.Sticky.compile(upstream.name)
+	}
+	upstream.discoverer = nil
+	var discovered []string
+	if upstream.Discovery != nil {
+		upstream.discoverer, _ = upstream.Discovery.compile()
+	}
+	if upstream.discoverer != nil {
+		var err error
+		if discovered, err = upstream.discoverer.discover(context.Background()); err != nil {
+			logger.Error("后端服务器池", upstream.name, "服务发现失败:", err)
 		}
 	}
+	upstream.mu.Lock()
+	upstream.discovered = discovered
+	upstream.rebuild()
+	upstream.mu.Unlock()
 }
 
-func (engine *Engine) resetEngine() {
+func (engine *Engine) writeEngine(cfg config) {
+	for _, v := range cfg.Upstream {
+		v.prepare()
+		v.start()
+	}
+	engine.service = cfg.Service
+	engine.upstream.store(cfg.Upstream)
+	engine.templates = cfg.templates
+}
+
+// 当前生效的配置
+func (engine *Engine) currentConfig() config {
+	return config{Service: engine.service, Upstream: engine.upstream.all(), templates: engine.templates}
+}
+
+// 热重启：先解析校验新配置、比对变化、预先绑定新端口、构建路由，全部成功后再原子切换。
+// 任何一步失败都会释放已经占用的资源，继续使用原来的配置
+func (engine *Engine) resetEngine() error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	//停止之后还在排队的热重启不再执行
+	select {
+	case <-engine.done:
+		return fmt.Errorf("engine stopped")
+	default:
+	}
 	engine.state = constant.ENGINE_RESET
-	readConfig(engine)
-	for key, value := range engine.resetServicesPoll {
-		//首先确定不存在的，启动服务
-		src, ok := engine.servicesPoll[key]
-		if !ok {
-			engine.wg.Add(1)
-			go value.listen(&engine.servicesPoll, &engine.upstream, &engine.wg)
-			continue
+	defer func() {
+		engine.state = constant.ENGINE_RUN
+	}()
+
+	cfg, err := loadConfig(NginxConfigFilepath)
+	if err != nil {
+		return fmt.Errorf("invalid config, keep running the previous one:\n%v", err)
+	}
+	//快照使用这次读到的配置，不再重新读取文件
+	applied := snapshotConfig(cfg)
+	diff := diffConfig(engine.currentConfig(), cfg)
+	logger.Infof("config changes:\n%s", diff)
+
+	//没有变化的后端服务器池沿用原来的对象，保留运行时状态
+	oldUpstreams := engine.upstream.all()
+	for name, v := range cfg.Upstream {
+		if diff.addedUpstreams[name] || diff.changedUpstreams[name] {
+			v.prepare()
+		} else {
+			cfg.Upstream[name] = oldUpstreams[name]
 		}
-		//如果已经存在，则确认哈希value是否是一致的
-		if value.hashValue != src.hashValue {
-			src.mu.Lock()
-			//如果不等于，则停掉原来的服务，再根据新的重启
-			delete(engine.servicesPoll, key)
-			err := src.httpService.Close()
-			if err != nil {
-				logger.Error("关闭服务错误：", err)
+	}
+
+	//预先绑定新增的端口，并构建变化的service的路由
+	var bound []*service
+	rollback := func() {
+		for _, s := range bound {
+			s.listener.Close()
+		}
+	}
+	for i, value := range cfg.Service {
+		src, running := engine.servicesPoll[value.Port]
+		switch {
+		case running && !diff.changedServices[value.Port]:
+			//没有变化的service沿用原来的对象
+			cfg.Service[i] = src
+			continue
+		case running:
+			//已经存在的端口沿用原来的监听，只替换路由
+			value.listener = src.listener
+			value.httpService = src.httpService
+			value.handler = src.handler
+		default:
+			//新增的端口，或者之前绑定失败的端口
+			if err := value.bind(); err != nil {
+				rollback()
+				return fmt.Errorf("rolled back to the previous config: %v", err)
 			}
-			engine.wg.Add(1)
-			go value.listen(&engine.servicesPoll, &engine.upstream, &engine.wg)
-			src.mu.Unlock()
+			bound = append(bound, value)
+		}
+		mux, err := value.buildHandler(&engine.upstream)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("rolled back to the previous config: %v", err)
+		}
+		value.mux = mux
+	}
+
+	//切换，新的后端服务器池开始健康检查，被替换和删除的停止
+	engine.upstream.store(cfg.Upstream)
+	for name, v := range cfg.Upstream {
+		if diff.addedUpstreams[name] || diff.changedUpstreams[name] {
+			v.start()
+		}
+	}
+	for name, v := range oldUpstreams {
+		if diff.changedUpstreams[name] || diff.removedUpstreams[name] {
+			v.stop()
+		}
+	}
+	engine.service = cfg.Service
+	newPoll := make(map[string]*service)
+	for _, value := range cfg.Service {
+		newPoll[value.Port] = value
+		if value.mux != nil {
+			value.handler.store(value.mux)
+			value.mux = nil
 		}
 	}
+	for _, value := range bound {
+		go value.serve()
+	}
 	//确认已经关掉的服务
 	for key, value := range engine.servicesPoll {
-		_, ok := engine.resetServicesPoll[key]
-		if !ok {
-			delete(engine.servicesPoll, key)
-			err := value.httpService.Close()
+		if _, ok := newPoll[key]; !ok {
+			err := value.close()
 			if err != nil {
 				logger.Error("关闭服务错误：", err)
 			}
 		}
 	}
-	engine.resetServicesPoll = make(map[string]*service) //释放内存
+	engine.servicesPoll = newPoll
+	engine.templates = cfg.templates
+	printJsonCfg(cfg)
+	recordSnapshot(applied)
+	return nil
+}
+
+// 记录生效的配置，失败时只打印日志
+func recordSnapshot(data []byte) {
+	snapshot, err := saveSnapshot(data, NginxConfigFilepath)
+	if err != nil {
+		logger.Error("保存配置快照失败：", err)
+		return
+	}
+	if snapshot != nil {
+		logger.Infof("config snapshot %s", snapshot.ID)
+	}
 }
 
 func (engine *Engine) stopEngine() {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	close(engine.done)
 	for _, value := range engine.servicesPoll {
-		value.httpService.Close()
+		value.close()
+	}
+	for _, value := range engine.upstream.all() {
+		value.stop()
 	}
 	logger.Info("程序退出")
 }
@@ -0,0 +1,670 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 获取一个空闲端口
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func proxyConfig(backend string, ports ...string) string {
+	var sb strings.Builder
+	for _, port := range ports {
+		fmt.Fprintf(&sb, "server {\n listen %s;\n location / { proxy_pass http://pool1; }\n}\n", port)
+	}
+	fmt.Fprintf(&sb, "upstream pool1 {\n server %s;\n}\n", backend)
+	return sb.String()
+}
+
+func get(port string) (string, error) {
+	resp, err := http.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// 启动一个使用给定配置文件的引擎
+func startTestEngine(t *testing.T, file string) *Engine {
+	old := NginxConfigFilepath
+	NginxConfigFilepath = file
+	t.Cleanup(func() {
+		NginxConfigFilepath = old
+	})
+	cfg, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := createEngine()
+	engine.writeEngine(cfg)
+	engine.Start()
+	t.Cleanup(engine.Stop)
+	return engine
+}
+
+func TestResetRollback(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	backendAddr := strings.TrimPrefix(backend.URL, "http://")
+
+	p1, p2 := freePort(t), freePort(t)
+	file := filepath.Join(t.TempDir(), "nginxgo.conf")
+	write := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(proxyConfig(backendAddr, p1))
+	engine := startTestEngine(t, file)
+	if body, err := get(p1); err != nil || body != "backend" {
+		t.Fatalf("unexpected response: %q, %v", body, err)
+	}
+
+	//新端口已被占用，重启失败，原来的端口继续服务
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, busyPort, _ := net.SplitHostPort(busy.Addr().String())
+	write(proxyConfig(backendAddr, p1, p2, busyPort))
+	if err := engine.Reset(); err == nil {
+		t.Fatal("expected bind error")
+	}
+	if body, err := get(p1); err != nil || body != "backend" {
+		t.Fatalf("previous config should keep running: %q, %v", body, err)
+	}
+	if _, err := get(p2); err == nil {
+		t.Fatal("pre-bound port should be released after rollback")
+	}
+
+	//无效配置
+	write("server { listen 80 }")
+	if err := engine.Reset(); err == nil {
+		t.Fatal("expected config error")
+	}
+
+	//没有变化的后端服务器池沿用原来的对象
+	pool := engine.upstream.get("pool1")
+	write(proxyConfig(backendAddr, p2))
+	if err := engine.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := get(p2); err != nil || body != "backend" {
+		t.Fatalf("unexpected response: %q, %v", body, err)
+	}
+	if _, err := get(p1); err == nil {
+		t.Fatal("removed port should be closed")
+	}
+	if engine.upstream.get("pool1") != pool {
+		t.Fatal("unchanged upstream should be reused")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	backendAddr := strings.TrimPrefix(backend.URL, "http://")
+
+	p1, p2 := freePort(t), freePort(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "nginxgo.conf")
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.WriteFile(file, []byte(proxyConfig(backendAddr, p1)+"include conf.d/*.conf;\n"), 0644)
+	engine := startTestEngine(t, file)
+	engine.startWatch(10*time.Millisecond, 50*time.Millisecond)
+
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 200; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	//include的目录中新增文件
+	os.WriteFile(filepath.Join(dir, "conf.d", "site.conf"), []byte(fmt.Sprintf("server { listen %s; location / { proxy_pass http://pool1; } }\n", p2)), 0644)
+	if !waitFor(func() bool { _, err := get(p2); return err == nil }) {
+		t.Fatal("new site was not loaded")
+	}
+	//无效的配置不影响正在运行的服务
+	os.WriteFile(filepath.Join(dir, "conf.d", "site.conf"), []byte("server {"), 0644)
+	time.Sleep(200 * time.Millisecond)
+	if body, err := get(p2); err != nil || body != "backend" {
+		t.Fatalf("invalid config should be refused: %q, %v", body, err)
+	}
+	os.Remove(filepath.Join(dir, "conf.d", "site.conf"))
+	if !waitFor(func() bool { _, err := get(p2); return err != nil }) {
+		t.Fatal("removed site is still running")
+	}
+}
+
+func TestResetAfterStop(t *testing.T) {
+	p1, p2 := freePort(t), freePort(t)
+	file := filepath.Join(t.TempDir(), "nginxgo.conf")
+	os.WriteFile(file, []byte(proxyConfig("127.0.0.1:1", p1)), 0644)
+	old := NginxConfigFilepath
+	NginxConfigFilepath = file
+	defer func() { NginxConfigFilepath = old }()
+	cfg, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := createEngine()
+	engine.writeEngine(cfg)
+	engine.Start()
+	engine.startWatch(10*time.Millisecond, 10*time.Millisecond)
+	engine.Stop()
+	//停止之后的热重启不能再绑定新的端口
+	os.WriteFile(file, []byte(proxyConfig("127.0.0.1:1", p1, p2)), 0644)
+	if err := engine.Reset(); err == nil {
+		t.Fatal("reset after stop should fail")
+	}
+	if _, err := get(p2); err == nil {
+		t.Fatal("stopped engine is serving a new port")
+	}
+}
+
+func TestSnapshotRollback(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	backendAddr := strings.TrimPrefix(backend.URL, "http://")
+
+	ConfigHistoryDir = t.TempDir()
+	defer func() {
+		ConfigHistoryDir = ""
+	}()
+	p1, p2 := freePort(t), freePort(t)
+	file := filepath.Join(t.TempDir(), "nginxgo.conf")
+	os.WriteFile(file, []byte(proxyConfig(backendAddr, p1)), 0644)
+	engine := startTestEngine(t, file)
+	cfg, _ := loadConfig(file)
+	recordSnapshot(snapshotConfig(cfg))
+
+	os.WriteFile(file, []byte(proxyConfig(backendAddr, p2)), 0644)
+	if err := engine.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	//内容相同的配置不重复保存
+	if err := engine.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 snapshots, got %d", len(snapshots))
+	}
+
+	if err := RestoreSnapshot(snapshots[0].ID, file); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := get(p1); err != nil || body != "backend" {
+		t.Fatalf("unexpected response after rollback: %q, %v", body, err)
+	}
+	if _, err := get(p2); err == nil {
+		t.Fatal("port of the newer config should be closed")
+	}
+	if _, err := os.Stat(file + ".bak"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreSnapshot("../x", file); err == nil {
+		t.Fatal("expected invalid id error")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	for _, hc := range []*healthCheck{
+		{Path: "/healthz", Interval: duration(-time.Second)},
+		{Path: "/healthz", Timeout: duration(-time.Second)},
+	} {
+		if _, err := hc.compile(); err == nil {
+			t.Fatalf("negative duration should be rejected: %+v", hc)
+		}
+	}
+	var healthy atomic.Bool
+	sick := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		io.WriteString(w, "sick")
+	}))
+	defer sick.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "good")
+	}))
+	defer good.Close()
+
+	file := writeTestConfig(t, "health.conf", fmt.Sprintf(`upstream pool1 {
+    policy round_robin;
+    health_check /healthz;
+    health_check_interval 10ms;
+    health_check_rise 1;
+    health_check_fall 1;
+    server %s;
+    server %s;
+}
+`, strings.TrimPrefix(sick.URL, "http://"), strings.TrimPrefix(good.URL, "http://")))
+	engine := startTestEngine(t, file)
+	u := engine.upstream.get("pool1")
+	waitFor := func(want int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if len(distribution(u, 10, nil)) == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %d healthy backends, got %v", want, distribution(u, 10, nil))
+	}
+	waitFor(1)
+	healthy.Store(true)
+	waitFor(2)
+}
+
+func TestPassiveFailures(t *testing.T) {
+	sick := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer sick.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "good")
+	}))
+	defer good.Close()
+	dead := "127.0.0.1:" + freePort(t)
+
+	port := freePort(t)
+	file := writeTestConfig(t, "passive.conf", fmt.Sprintf(`server {
+    listen %s;
+    location / { proxy_pass http://pool1; }
+}
+upstream pool1 {
+    policy round_robin;
+    fail_status 500-599;
+    server %s max_fails=2 fail_timeout=300ms;
+    server %s max_fails=2 fail_timeout=300ms;
+    server %s;
+}
+`, port, dead, strings.TrimPrefix(sick.URL, "http://"), strings.TrimPrefix(good.URL, "http://")))
+	startTestEngine(t, file)
+	//每个失败的后端服务器失败两次后暂停使用
+	for i := 0; i < 6; i++ {
+		get(port)
+	}
+	for i := 0; i < 6; i++ {
+		if body, err := get(port); err != nil || body != "good" {
+			t.Fatalf("failed backend still in use: %q, %v", body, err)
+		}
+	}
+	//fail_timeout之后自动恢复
+	time.Sleep(400 * time.Millisecond)
+	failed := 0
+	for i := 0; i < 6; i++ {
+		if body, _ := get(port); body != "good" {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Fatal("failed backends were not reinstated")
+	}
+}
+
+func TestNextUpstream(t *testing.T) {
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer flaky.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "good"+string(body))
+	}))
+	defer good.Close()
+	dead := "127.0.0.1:" + freePort(t)
+	backends := fmt.Sprintf("server %s max_fails=0;\n server %s max_fails=0;\n server %s;\n",
+		dead, strings.TrimPrefix(flaky.URL, "http://"), strings.TrimPrefix(good.URL, "http://"))
+
+	port := freePort(t)
+	file := writeTestConfig(t, "retry.conf", fmt.Sprintf(`server {
+    listen %s;
+    location /idempotent/ { proxy_pass http://pool1; }
+    location /any/ { proxy_pass http://pool2; }
+}
+upstream pool1 {
+    policy round_robin;
+    proxy_next_upstream error timeout http_503;
+    %s
+}
+upstream pool2 {
+    policy round_robin;
+    proxy_next_upstream error http_503 non_idempotent;
+    proxy_next_upstream_body_size 8;
+    %s
+}
+`, port, backends, backends))
+	startTestEngine(t, file)
+	post := func(path, body string) string {
+		resp, err := http.Post("http://127.0.0.1:"+port+path, "text/plain", strings.NewReader(body))
+		if err != nil {
+			return err.Error()
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return string(data)
+	}
+	for i := 0; i < 6; i++ {
+		if body, err := get(port + "/idempotent"); err != nil || body != "good" {
+			t.Fatalf("GET was not retried: %q, %v", body, err)
+		}
+		if body := post("/any/", "body"); body != "goodbody" {
+			t.Fatalf("POST with non_idempotent was not retried: %q", body)
+		}
+	}
+	//非幂等请求和超过缓存上限的请求体不重试
+	var failed, large int
+	for i := 0; i < 6; i++ {
+		if post("/idempotent/", "body") != "goodbody" {
+			failed++
+		}
+		if post("/any/", "large body") != "goodlarge body" {
+			large++
+		}
+	}
+	if failed == 0 || large == 0 {
+		t.Fatalf("unexpected retries: %d non idempotent failures, %d large body failures", failed, large)
+	}
+}
+
+func TestBackupAndFallback(t *testing.T) {
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backup")
+	}))
+	defer backup.Close()
+	dead := "127.0.0.1:" + freePort(t)
+	page := writeTestConfig(t, "maintenance.html", "<h1>maintenance</h1>")
+
+	port := freePort(t)
+	file := writeTestConfig(t, "fallback.conf", fmt.Sprintf(`server {
+    listen %s;
+    location /backup/ { proxy_pass http://pool1; }
+    location /dead/ { proxy_pass http://pool2; }
+}
+upstream pool1 {
+    server %s max_fails=1;
+    server %s backup;
+}
+upstream pool2 {
+    fallback_status 503;
+    fallback_file %s;
+    server %s max_fails=1;
+}
+`, port, dead, strings.TrimPrefix(backup.URL, "http://"), page, dead))
+	startTestEngine(t, file)
+	for i := 0; i < 3; i++ {
+		if body, err := get(port + "/backup"); err != nil || body != "backup" {
+			t.Fatalf("backup server not used: %q, %v", body, err)
+		}
+	}
+	//连接失败和摘除之后都返回兜底响应
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get("http://127.0.0.1:" + port + "/dead/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "<h1>maintenance</h1>" ||
+			!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatalf("unexpected fallback response: %d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	newBackend := func(name string) string {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(backend.Close)
+		return strings.TrimPrefix(backend.URL, "http://")
+	}
+	a, b := newBackend("a"), newBackend("b")
+	port := freePort(t)
+	file := writeTestConfig(t, "admin.conf", fmt.Sprintf(`server {
+    listen %s;
+    location / { proxy_pass http://pool1; }
+}
+upstream pool1 {
+    policy round_robin;
+    server %s;
+}
+`, port, a))
+	engine := startTestEngine(t, file)
+	if err := engine.ServeAdmin("0.0.0.0:0"); err == nil {
+		t.Fatal("expected non-loopback admin address to be rejected")
+	}
+	admin := httptest.NewServer(engine.adminHandler())
+	defer admin.Close()
+	call := func(method, path, body string, want int) adminUpstream {
+		t.Helper()
+		req, _ := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s: expected %d, got %d %s", method, path, want, resp.StatusCode, data)
+		}
+		var result adminUpstream
+		json.Unmarshal(data, &result)
+		return result
+	}
+	responses := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			body, _ := get(port)
+			counts[body]++
+		}
+		return counts
+	}
+
+	//跨站请求：不是application/json的修改请求和不是本机的Host都拒绝
+	reject := func(req *http.Request, want int) {
+		t.Helper()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s with host %q: expected %d, got %d", req.Method, req.URL.Path, req.Host, want, resp.StatusCode)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodPost, admin.URL+"/upstreams/pool1/backends", strings.NewReader(`{"server": "`+b+`"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	reject(req, http.StatusUnsupportedMediaType)
+	req, _ = http.NewRequest(http.MethodDelete, admin.URL+"/upstreams/pool1/backends/"+a, nil)
+	reject(req, http.StatusUnsupportedMediaType)
+	req, _ = http.NewRequest(http.MethodPost, admin.URL+"/upstreams/pool1/backends", strings.NewReader(`{"server": "`+b+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	_, adminPort, _ := net.SplitHostPort(admin.Listener.Addr().String())
+	req.Host = "attacker.example:" + adminPort
+	reject(req, http.StatusForbidden)
+	req, _ = http.NewRequest(http.MethodGet, admin.URL+"/upstreams", nil)
+	req.Host = "attacker.example"
+	reject(req, http.StatusForbidden)
+	if status := call(http.MethodGet, "/upstreams/pool1", "", http.StatusOK); len(status.Backends) != 1 {
+		t.Fatalf("rejected request was applied: %+v", status)
+	}
+
+	call(http.MethodPost, "/upstreams/pool1/backends?persist=true", `{"server": "`+b+` weight=2"}`, http.StatusCreated)
+	call(http.MethodPost, "/upstreams/pool1/backends", `{"server": "`+b+`"}`, http.StatusConflict)
+	call(http.MethodPost, "/upstreams/pool2/backends", `{"server": "`+b+`"}`, http.StatusNotFound)
+	if counts := responses(); counts["a"] != 2 || counts["b"] != 2 {
+		t.Fatalf("added backend not used: %v", counts)
+	}
+	if data, _ := os.ReadFile(file); !strings.Contains(string(data), "server "+b+" weight=2;") {
+		t.Fatalf("added backend not persisted:\n%s", data)
+	}
+
+	status := call(http.MethodPut, "/upstreams/pool1/backends/"+b+"/weight", `{"weight": 5}`, http.StatusOK)
+	if len(status.Backends) != 2 || status.Backends[1].Server != b+" weight=5" || status.Backends[1].Weight != 5 {
+		t.Fatalf("unexpected status after changing weight: %+v", status)
+	}
+	call(http.MethodPut, "/upstreams/pool1/backends/"+b+"/weight", `{"weight": 0}`, http.StatusBadRequest)
+
+	//摘除后不再接收请求，恢复后重新接收
+	status = call(http.MethodPost, "/upstreams/pool1/backends/"+a+"/drain", "", http.StatusOK)
+	if !status.Backends[0].Draining || status.Backends[0].Available {
+		t.Fatalf("backend not drained: %+v", status)
+	}
+	if counts := responses(); counts["b"] != 4 {
+		t.Fatalf("drained backend still used: %v", counts)
+	}
+	call(http.MethodDelete, "/upstreams/pool1/backends/"+a+"/drain", "", http.StatusOK)
+
+	status = call(http.MethodDelete, "/upstreams/pool1/backends/"+b+"?persist=true", "", http.StatusOK)
+	if len(status.Backends) != 1 || status.Backends[0].Addr != a {
+		t.Fatalf("unexpected status after removing backend: %+v", status)
+	}
+	if counts := responses(); counts["a"] != 4 {
+		t.Fatalf("removed backend still used: %v", counts)
+	}
+	if data, _ := os.ReadFile(file); strings.Contains(string(data), b) {
+		t.Fatalf("removed backend still in config:\n%s", data)
+	}
+	call(http.MethodDelete, "/upstreams/pool1/backends/"+b, "", http.StatusNotFound)
+
+	//不能删掉最后一个主服务器
+	call(http.MethodDelete, "/upstreams/pool1/backends/"+a+"?persist=true", "", http.StatusConflict)
+	//运行时还有b，但是写回后配置文件中没有后端服务器，校验不通过时不修改文件和运行时的列表
+	call(http.MethodPost, "/upstreams/pool1/backends", `{"server": "`+b+`"}`, http.StatusCreated)
+	before, _ := os.ReadFile(file)
+	call(http.MethodDelete, "/upstreams/pool1/backends/"+a+"?persist=true", "", http.StatusUnprocessableEntity)
+	if data, _ := os.ReadFile(file); string(data) != string(before) {
+		t.Fatalf("invalid config was written:\n%s", data)
+	}
+	if status := call(http.MethodGet, "/upstreams/pool1", "", http.StatusOK); len(status.Backends) != 2 {
+		t.Fatalf("rejected change was applied: %+v", status)
+	}
+}
+
+func TestPersistInclude(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.conf")
+	content := "include site.conf;\nupstream pool1 { server 127.0.0.1:1; }\n"
+	os.WriteFile(main, []byte(content), 0644)
+	os.WriteFile(filepath.Join(dir, "site.conf"), []byte("upstream pool2 { server 127.0.0.1:2; }\n"), 0644)
+	if _, err := persistMembers(main, "pool1", addBackend("127.0.0.1:3")); err == nil {
+		t.Fatal("persisting a config with include should fail")
+	}
+	if data, _ := os.ReadFile(main); string(data) != content {
+		t.Fatalf("config with include was rewritten:\n%s", data)
+	}
+}
+
+func TestStickyCookie(t *testing.T) {
+	newBackend := func(name string) string {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(backend.Close)
+		return strings.TrimPrefix(backend.URL, "http://")
+	}
+	a, b := newBackend("a"), newBackend("b")
+	port := freePort(t)
+	file := writeTestConfig(t, "sticky.conf", fmt.Sprintf(`server {
+    listen %s;
+    location / { proxy_pass http://pool1; }
+}
+upstream pool1 {
+    policy round_robin;
+    sticky cookie route expires=1h httponly;
+    sticky_secret s3cret;
+    server %s;
+    server %s;
+}
+`, port, a, b))
+	engine := startTestEngine(t, file)
+	request := func(cookie string) (string, *http.Cookie) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:"+port+"/", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "route", Value: cookie})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		for _, c := range resp.Cookies() {
+			if c.Name == "route" {
+				return string(body), c
+			}
+		}
+		return string(body), nil
+	}
+
+	first, cookie := request("")
+	if cookie == nil || cookie.MaxAge != 3600 || !cookie.HttpOnly || strings.Contains(cookie.Value, "127.0.0.1") {
+		t.Fatalf("unexpected sticky cookie: %+v", cookie)
+	}
+	//带着cookie的请求一直转给同一个后端服务器，不再下发cookie
+	for i := 0; i < 4; i++ {
+		if body, reissued := request(cookie.Value); body != first || reissued != nil {
+			t.Fatalf("request %d: expected %q without a new cookie, got %q %+v", i, first, body, reissued)
+		}
+	}
+	//伪造的cookie按负载均衡策略选择，并下发新的cookie
+	if _, reissued := request("0123456789abcdef01234567"); reissued == nil {
+		t.Fatal("expected a new cookie for a forged one")
+	}
+	//cookie指向的后端服务器不可用时换一个，并下发指向新后端服务器的cookie
+	for _, p := range engine.upstream.get("pool1").state.Load().peers {
+		if p.addr == map[string]string{"a": a, "b": b}[first] {
+			p.draining.Store(true)
+		}
+	}
+	body, reissued := request(cookie.Value)
+	if body == first || reissued == nil || reissued.Value == cookie.Value {
+		t.Fatalf("expected another backend and a new cookie, got %q %+v", body, reissued)
+	}
+	if again, _ := request(reissued.Value); again != body {
+		t.Fatalf("expected %q with the new cookie, got %q", body, again)
+	}
+}
@@ -0,0 +1,108 @@
+package core
+
+//后端服务器响应时间和错误率的指数加权移动平均（EWMA），以及按响应时间选择的peak_ewma策略
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 一个后端服务器的请求统计
+type ewmaStats struct {
+	mu        sync.Mutex
+	latency   float64   //响应时间的peak EWMA（纳秒），变大时立即跟上，变小时按时间衰减
+	stamp     time.Time //最后一次更新响应时间的时间
+	measured  bool      //是否有过成功的请求
+	errorRate float64   //错误率的EWMA
+	requests  int64     //上次异常检测之后的请求数
+}
+
+// 记录一次请求的结果。失败的请求只计入错误率，连接被拒绝之类的快速失败不会拉低响应时间
+func (s *ewmaStats) observe(latency time.Duration, failed bool) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if failed {
+		s.errorRate += constant.EWMA_ERROR_ALPHA * (1 - s.errorRate)
+		return
+	}
+	s.errorRate -= constant.EWMA_ERROR_ALPHA * s.errorRate
+	sample := float64(latency)
+	switch {
+	case !s.measured || sample > s.latency:
+		s.latency = sample
+	default:
+		w := decay(now.Sub(s.stamp))
+		s.latency = s.latency*w + sample*(1-w)
+	}
+	s.stamp = now
+	s.measured = true
+}
+
+// 当前的响应时间和错误率。长时间没有请求时响应时间向0衰减，慢的后端服务器过一段时间后重新获得请求
+func (s *ewmaStats) load(now time.Time) (latency, errorRate float64, measured bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.measured {
+		return 0, s.errorRate, false
+	}
+	return s.latency * decay(now.Sub(s.stamp)), s.errorRate, true
+}
+
+// 取出并清零上次异常检测之后的请求数
+func (s *ewmaStats) takeRequests() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.requests
+	s.requests = 0
+	return n
+}
+
+// 清空统计，被摘除的后端服务器恢复后重新统计
+func (s *ewmaStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency, s.measured, s.errorRate, s.requests = 0, false, 0, 0
+}
+
+// 经过elapsed之后旧值的权重
+func decay(elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 1
+	}
+	return math.Exp(-float64(elapsed) / float64(constant.EWMA_DECAY))
+}
+
+// peak EWMA：随机选两个，取 响应时间*(正在处理的请求数+1)/权重 较低的一个
+type peakEWMA struct {
+	peers []*peer
+}
+
+func newPeakEWMA(peers []*peer, _ *upstream) balancer {
+	return &peakEWMA{peers: peers}
+}
+
+func (pe *peakEWMA) pick(_ string, skip func(*peer) bool) *peer {
+	peers := candidates(pe.peers, skip)
+	a := weightedRandom(peers)
+	b := weightedRandom(peers)
+	if a == nil || b == nil || cheaper(a, b) {
+		return a
+	}
+	return b
+}
+
+// a的代价是否比b低。有一个还没有响应时间时按正在处理的请求数比较
+func cheaper(a, b *peer) bool {
+	now := time.Now()
+	la, _, ma := a.stats.load(now)
+	lb, _, mb := b.stats.load(now)
+	if !ma || !mb {
+		return less(a, b)
+	}
+	return la*float64(a.inflight.Load()+1)*float64(b.weight) < lb*float64(b.inflight.Load()+1)*float64(a.weight)
+}
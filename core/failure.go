@@ -0,0 +1,59 @@
+package core
+
+//被动失败检测：请求失败过多的后端服务器暂停使用fail_timeout，之后自动恢复
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// 记录一次请求失败。fail_timeout内失败max_fails次后暂停使用fail_timeout，同时计入熔断器
+func (p *peer) fail(name string, err error) {
+	p.breaker.record(false)
+	if p.maxFails == 0 {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	//滑动窗口，去掉窗口外的失败
+	cutoff := now.Add(-p.failTimeout)
+	i := 0
+	for i < len(p.failures) && p.failures[i].Before(cutoff) {
+		i++
+	}
+	p.failures = append(p.failures[i:], now)
+	if len(p.failures) < p.maxFails {
+		p.failing.Store(true)
+		return
+	}
+	p.failures = nil
+	p.failing.Store(false)
+	p.downUntil.Store(now.Add(p.failTimeout).UnixNano())
+	p.warmUp(now.Add(p.failTimeout))
+	logger.Warn("后端服务器池", name, "后端服务器", p.addr, "失败", p.maxFails, "次，暂停使用", p.failTimeout, "，最后一次错误:", err)
+}
+
+// 记录一次请求成功，清空失败记录
+func (p *peer) succeed(name string) {
+	p.breaker.record(true)
+	//暂停期间发出的请求成功不算恢复
+	if until := p.downUntil.Load(); until != 0 && until <= time.Now().UnixNano() && p.downUntil.CompareAndSwap(until, 0) {
+		logger.Info("后端服务器池", name, "后端服务器", p.addr, "已恢复")
+	}
+	if !p.failing.Load() {
+		return
+	}
+	p.mu.Lock()
+	p.failures = nil
+	p.failing.Store(false)
+	p.mu.Unlock()
+}
+
+// 是否为超时错误
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
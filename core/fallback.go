@@ -0,0 +1,96 @@
+package core
+
+//所有后端服务器都不可用时的兜底响应
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 兜底响应配置
+type fallback struct {
+	Status int    `json:"status,omitempty"` //状态码，默认503
+	Body   string `json:"body,omitempty"`   //响应体
+	File   string `json:"file,omitempty"`   //响应体文件，优先于body
+}
+
+// 设置兜底响应的配置项
+func (fb *fallback) setOption(key, value string) error {
+	switch key {
+	case constant.FALLBACK_STATUS:
+		status, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s 字段设置错误：%q is not a number", key, value)
+		}
+		fb.Status = status
+	case constant.FALLBACK_BODY:
+		fb.Body = value
+	case constant.FALLBACK_FILE:
+		fb.File = value
+	default:
+		return fmt.Errorf("unknown key %q in upstream", key)
+	}
+	return nil
+}
+
+// 已设置的配置项，用于输出[server]风格的配置
+func (fb *fallback) options() [][2]string {
+	var options [][2]string
+	if fb.Status != 0 {
+		options = append(options, [2]string{constant.FALLBACK_STATUS, strconv.Itoa(fb.Status)})
+	}
+	if fb.Body != "" {
+		options = append(options, [2]string{constant.FALLBACK_BODY, fb.Body})
+	}
+	if fb.File != "" {
+		options = append(options, [2]string{constant.FALLBACK_FILE, fb.File})
+	}
+	return options
+}
+
+// 校验兜底响应配置
+func (fb *fallback) validate() error {
+	if fb.Status != 0 && (fb.Status < 200 || fb.Status > 599) {
+		return fmt.Errorf("invalid %s %d", constant.FALLBACK_STATUS, fb.Status)
+	}
+	if fb.File != "" {
+		if _, err := os.Stat(fb.File); err != nil {
+			return fmt.Errorf("%s: %v", constant.FALLBACK_FILE, err)
+		}
+	}
+	return nil
+}
+
+// 写兜底响应，文件每次重新读取，修改维护页面不需要热重启
+func (fb *fallback) serve(w http.ResponseWriter) {
+	status := fb.Status
+	if status == 0 {
+		status = constant.DEFAULT_FALLBACK_STATUS
+	}
+	body := []byte(fb.Body)
+	contentType := "text/plain; charset=utf-8"
+	if fb.File != "" {
+		data, err := os.ReadFile(fb.File)
+		if err != nil {
+			logger.Error("读取兜底响应文件错误:", err)
+			http.Error(w, "没有可用的后端服务器", http.StatusBadGateway)
+			return
+		}
+		body = data
+		if t := mime.TypeByExtension(filepath.Ext(fb.File)); t != "" {
+			contentType = t
+		} else {
+			contentType = http.DetectContentType(data)
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -3,21 +3,12 @@ package core
 import (
 	"net/http"
 	"os"
-	"sync"
 )
 
 //提供文件服务
 
-func (location *location) getFile(w http.ResponseWriter, r *http.Request, mu *sync.Mutex) {
+func (location *location) getFile(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
-	//询问是否正在热重启。如果是则返回503，服务器维护状态码。
-	isNotReSet := mu.TryLock()
-	if !isNotReSet {
-		http.Error(w, "服务重启中，请重试", http.StatusServiceUnavailable)
-		return
-	} else {
-		mu.Unlock()
-	}
 
 	file, err := os.ReadFile(location.FileRoot)
 	if err != nil {
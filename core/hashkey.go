@@ -0,0 +1,116 @@
+package core
+
+//一致性哈希的哈希键模板
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 解析后的哈希键模板，由字面量和变量交替组成
+type hashKey []hashKeyPart
+
+type hashKeyPart struct {
+	literal  string
+	variable string //变量名，为空时是字面量
+}
+
+// 解析哈希键模板，例如"$cookie_user"、"$http_x_tenant:$uri"。空模板表示使用客户端ip
+func parseHashKey(template string) (hashKey, error) {
+	var key hashKey
+	for i := 0; i < len(template); {
+		if template[i] != '$' {
+			end := strings.IndexByte(template[i:], '$')
+			if end < 0 {
+				end = len(template) - i
+			}
+			key = append(key, hashKeyPart{literal: template[i : i+end]})
+			i += end
+			continue
+		}
+		end := i + 1
+		for end < len(template) && isVariableChar(template[end]) {
+			end++
+		}
+		name := template[i+1 : end]
+		if !isHashKeyVariable(name) {
+			return nil, fmt.Errorf("hash_key: unknown variable \"$%s\"", name)
+		}
+		key = append(key, hashKeyPart{variable: name})
+		i = end
+	}
+	return key, nil
+}
+
+func isVariableChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func isHashKeyVariable(name string) bool {
+	switch name {
+	case constant.HASH_KEY_REMOTE_ADDR, constant.HASH_KEY_HOST, constant.HASH_KEY_URI, constant.HASH_KEY_REQUEST_URI:
+		return true
+	}
+	for _, prefix := range []string{constant.HASH_KEY_HTTP_PREFIX, constant.HASH_KEY_COOKIE_PREFIX, constant.HASH_KEY_ARG_PREFIX} {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 计算请求的哈希键。模板为空或者其中的变量都取不到值时使用客户端ip
+func (key hashKey) eval(r *http.Request, ip string) string {
+	if len(key) == 0 {
+		return ip
+	}
+	var sb strings.Builder
+	found := false
+	for _, part := range key {
+		if part.variable == "" {
+			sb.WriteString(part.literal)
+			continue
+		}
+		value := variableValue(r, ip, part.variable)
+		if value != "" {
+			found = true
+		}
+		sb.WriteString(value)
+	}
+	if !found {
+		return ip
+	}
+	return sb.String()
+}
+
+// 取变量的值，取不到时返回空字符串
+func variableValue(r *http.Request, ip, name string) string {
+	switch name {
+	case constant.HASH_KEY_REMOTE_ADDR:
+		return ip
+	case constant.HASH_KEY_HOST:
+		return r.Host
+	case constant.HASH_KEY_URI:
+		return r.URL.Path
+	case constant.HASH_KEY_REQUEST_URI:
+		return r.URL.RequestURI()
+	}
+	switch {
+	case strings.HasPrefix(name, constant.HASH_KEY_HTTP_PREFIX):
+		//"$http_x_user"对应请求头X-User
+		header := strings.ReplaceAll(strings.TrimPrefix(name, constant.HASH_KEY_HTTP_PREFIX), "_", "-")
+		return r.Header.Get(header)
+	case strings.HasPrefix(name, constant.HASH_KEY_COOKIE_PREFIX):
+		cookie, err := r.Cookie(strings.TrimPrefix(name, constant.HASH_KEY_COOKIE_PREFIX))
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	case strings.HasPrefix(name, constant.HASH_KEY_ARG_PREFIX):
+		return r.URL.Query().Get(strings.TrimPrefix(name, constant.HASH_KEY_ARG_PREFIX))
+	}
+	return ""
+}
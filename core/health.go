@@ -0,0 +1,281 @@
+package core
+
+//后端服务器的主动健康检查
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 健康检查配置
+type healthCheck struct {
+	Path     string   `json:"path"`               //检查路径
+	Interval duration `json:"interval,omitempty"` //检查间隔，默认5s
+	Timeout  duration `json:"timeout,omitempty"`  //单次检查超时，默认2s
+	Status   string   `json:"status,omitempty"`   //健康的状态码，默认200-399
+	Body     string   `json:"body,omitempty"`     //响应体需要匹配的正则表达式
+	Rise     int      `json:"rise,omitempty"`     //连续成功多少次后恢复，默认2
+	Fall     int      `json:"fall,omitempty"`     //连续失败多少次后摘除，默认3
+}
+
+// 设置健康检查的配置项
+func (hc *healthCheck) setOption(key, value string) error {
+	switch key {
+	case constant.HEALTH_CHECK:
+		hc.Path = value
+	case constant.HEALTH_CHECK_INTERVAL, constant.HEALTH_CHECK_TIMEOUT:
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		if key == constant.HEALTH_CHECK_INTERVAL {
+			hc.Interval = d
+		} else {
+			hc.Timeout = d
+		}
+	case constant.HEALTH_CHECK_STATUS:
+		hc.Status = value
+	case constant.HEALTH_CHECK_BODY:
+		hc.Body = value
+	case constant.HEALTH_CHECK_RISE, constant.HEALTH_CHECK_FALL:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("%s 字段设置错误：%q is not a positive number", key, value)
+		}
+		if key == constant.HEALTH_CHECK_RISE {
+			hc.Rise = n
+		} else {
+			hc.Fall = n
+		}
+	default:
+		return fmt.Errorf("unknown key %q in upstream", key)
+	}
+	return nil
+}
+
+// 已设置的配置项，用于输出[server]风格的配置
+func (hc *healthCheck) options() [][2]string {
+	options := [][2]string{{constant.HEALTH_CHECK, hc.Path}}
+	if hc.Interval != 0 {
+		options = append(options, [2]string{constant.HEALTH_CHECK_INTERVAL, hc.Interval.String()})
+	}
+	if hc.Timeout != 0 {
+		options = append(options, [2]string{constant.HEALTH_CHECK_TIMEOUT, hc.Timeout.String()})
+	}
+	if hc.Status != "" {
+		options = append(options, [2]string{constant.HEALTH_CHECK_STATUS, hc.Status})
+	}
+	if hc.Body != "" {
+		options = append(options, [2]string{constant.HEALTH_CHECK_BODY, hc.Body})
+	}
+	if hc.Rise != 0 {
+		options = append(options, [2]string{constant.HEALTH_CHECK_RISE, strconv.Itoa(hc.Rise)})
+	}
+	if hc.Fall != 0 {
+		options = append(options, [2]string{constant.HEALTH_CHECK_FALL, strconv.Itoa(hc.Fall)})
+	}
+	return options
+}
+
+// 补全默认值并解析后的健康检查配置
+type healthChecker struct {
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	status   [][2]int //健康的状态码区间
+	body     *regexp.Regexp
+	rise     int
+	fall     int
+}
+
+// 校验并解析健康检查配置
+func (hc *healthCheck) compile() (*healthChecker, error) {
+	if !strings.HasPrefix(hc.Path, "/") {
+		return nil, fmt.Errorf("invalid %s path %q, must start with \"/\"", constant.HEALTH_CHECK, hc.Path)
+	}
+	checker := &healthChecker{
+		path:     hc.Path,
+		interval: time.Duration(hc.Interval),
+		timeout:  time.Duration(hc.Timeout),
+		rise:     hc.Rise,
+		fall:     hc.Fall,
+	}
+	if checker.interval == 0 {
+		checker.interval = constant.DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	if checker.timeout == 0 {
+		checker.timeout = constant.DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	if checker.rise == 0 {
+		checker.rise = constant.DEFAULT_HEALTH_CHECK_RISE
+	}
+	if checker.fall == 0 {
+		checker.fall = constant.DEFAULT_HEALTH_CHECK_FALL
+	}
+	//JSON/YAML中的负数也在这里拦住，否则启动时NewTicker会panic
+	switch {
+	case checker.interval <= 0:
+		return nil, fmt.Errorf("invalid %s %v, must be positive", constant.HEALTH_CHECK_INTERVAL, hc.Interval)
+	case checker.timeout <= 0:
+		return nil, fmt.Errorf("invalid %s %v, must be positive", constant.HEALTH_CHECK_TIMEOUT, hc.Timeout)
+	}
+	status := hc.Status
+	if status == "" {
+		status = constant.DEFAULT_HEALTH_CHECK_STATUS
+	}
+	ranges, err := parseStatusRanges(status)
+	if err != nil {
+		return nil, err
+	}
+	checker.status = ranges
+	if hc.Body != "" {
+		checker.body, err = regexp.Compile(hc.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", constant.HEALTH_CHECK_BODY, err)
+		}
+	}
+	return checker, nil
+}
+
+// 解析状态码列表，例如"200-399"、"200,204,301-302"
+func parseStatusRanges(value string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, item := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		if !isRange {
+			to = from
+		}
+		low, err1 := strconv.Atoi(from)
+		high, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || low < 100 || high > 599 || low > high {
+			return nil, fmt.Errorf("invalid status %q", value)
+		}
+		ranges = append(ranges, [2]int{low, high})
+	}
+	return ranges, nil
+}
+
+// 状态码是否在区间内
+func statusIn(ranges [][2]int, code int) bool {
+	for _, r := range ranges {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// 启动后台健康检查、异常检测和服务发现，后端服务器池切换生效后调用
+func (upstream *upstream) start() {
+	var checker *healthChecker
+	if upstream.HealthCheck != nil {
+		var err error
+		checker, err = upstream.HealthCheck.compile()
+		if err != nil {
+			logger.Error("后端服务器池", upstream.name, "健康检查配置错误:", err)
+		}
+	}
+	if checker == nil && upstream.outlier == nil && upstream.discoverer == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	upstream.cancel = cancel
+	if checker != nil {
+		go upstream.healthLoop(ctx, checker)
+	}
+	if upstream.outlier != nil {
+		go upstream.outlierLoop(ctx, upstream.outlier)
+	}
+	if upstream.discoverer != nil {
+		go upstream.discoveryLoop(ctx, upstream.discoverer)
+	}
+}
+
+// 停止后台任务，后端服务器池被替换或者删除时调用
+func (upstream *upstream) stop() {
+	if upstream.cancel != nil {
+		upstream.cancel()
+	}
+}
+
+// 每个间隔并发检查一遍当前的所有后端服务器
+func (upstream *upstream) healthLoop(ctx context.Context, checker *healthChecker) {
+	client := &http.Client{Transport: upstream.transport, Timeout: checker.timeout}
+	ticker := time.NewTicker(checker.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, p := range upstream.state.Load().peers {
+			wg.Add(1)
+			go func(p *peer) {
+				defer wg.Done()
+				err := checker.check(ctx, client, upstream.Scheme, p.addr)
+				if ctx.Err() != nil {
+					return
+				}
+				p.report(upstream.name, checker, err)
+			}(p)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 检查一次，健康时返回nil
+func (checker *healthChecker) check(ctx context.Context, client *http.Client, scheme, addr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+addr+checker.path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !statusIn(checker.status, resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if checker.body != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, constant.HEALTH_CHECK_MAX_BODY))
+		if err != nil {
+			return err
+		}
+		if !checker.body.Match(body) {
+			return fmt.Errorf("body does not match %q", checker.body)
+		}
+	}
+	return nil
+}
+
+// 记录检查结果，连续失败fall次后摘除，连续成功rise次后恢复
+func (p *peer) report(name string, checker *healthChecker, err error) {
+	if err != nil {
+		p.rise = 0
+		p.fall++
+		if p.fall >= checker.fall && !p.unhealthy.Load() {
+			p.unhealthy.Store(true)
+			logger.Warn("后端服务器池", name, "后端服务器", p.addr, "健康检查失败，已摘除:", err)
+		}
+		return
+	}
+	p.fall = 0
+	p.rise++
+	if p.rise >= checker.rise && p.unhealthy.Load() {
+		p.unhealthy.Store(false)
+		p.warmUp(time.Now())
+		logger.Info("后端服务器池", name, "后端服务器", p.addr, "健康检查恢复")
+	}
+}
@@ -0,0 +1,222 @@
+package core
+
+//异常检测：定期比较各个后端服务器的响应时间和错误率，明显偏高的暂时摘除
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 异常检测配置
+type outlierDetection struct {
+	Interval           duration `json:"interval,omitempty"`             //检测间隔，默认10s
+	LatencyFactor      *float64 `json:"latency_factor,omitempty"`       //响应时间超过其他后端服务器中位数的多少倍时摘除，默认3，0表示不按响应时间摘除
+	ErrorRate          *float64 `json:"error_rate,omitempty"`           //错误率达到多少时摘除，默认0.5，0表示不按错误率摘除
+	MinRequests        int      `json:"min_requests,omitempty"`         //检测间隔内请求数达到多少才参与检测，默认20
+	EjectionTime       duration `json:"ejection_time,omitempty"`        //摘除时长，默认30s
+	MaxEjectionPercent int      `json:"max_ejection_percent,omitempty"` //同时最多摘除的后端服务器比例，默认50
+}
+
+// 设置异常检测的配置项
+func (od *outlierDetection) setOption(key, value string) error {
+	switch key {
+	case constant.OUTLIER_DETECTION_INTERVAL, constant.OUTLIER_DETECTION_EJECTION_TIME:
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		if key == constant.OUTLIER_DETECTION_INTERVAL {
+			od.Interval = d
+		} else {
+			od.EjectionTime = d
+		}
+	case constant.OUTLIER_DETECTION_LATENCY_FACTOR, constant.OUTLIER_DETECTION_ERROR_RATE:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s 字段设置错误：%q is not a number", key, value)
+		}
+		if key == constant.OUTLIER_DETECTION_LATENCY_FACTOR {
+			od.LatencyFactor = &f
+		} else {
+			od.ErrorRate = &f
+		}
+	case constant.OUTLIER_DETECTION_MIN_REQUESTS, constant.OUTLIER_DETECTION_MAX_EJECTION_PERCENT:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s 字段设置错误：%q is not a number", key, value)
+		}
+		if key == constant.OUTLIER_DETECTION_MIN_REQUESTS {
+			od.MinRequests = n
+		} else {
+			od.MaxEjectionPercent = n
+		}
+	default:
+		return fmt.Errorf("unknown key %q in upstream", key)
+	}
+	return nil
+}
+
+// 已设置的配置项，用于输出[server]风格的配置
+func (od *outlierDetection) options() [][2]string {
+	var options [][2]string
+	if od.Interval != 0 {
+		options = append(options, [2]string{constant.OUTLIER_DETECTION_INTERVAL, od.Interval.String()})
+	}
+	if od.LatencyFactor != nil {
+		options = append(options, [2]string{constant.OUTLIER_DETECTION_LATENCY_FACTOR, strconv.FormatFloat(*od.LatencyFactor, 'g', -1, 64)})
+	}
+	if od.ErrorRate != nil {
+		options = append(options, [2]string{constant.OUTLIER_DETECTION_ERROR_RATE, strconv.FormatFloat(*od.ErrorRate, 'g', -1, 64)})
+	}
+	if od.MinRequests != 0 {
+		options = append(options, [2]string{constant.OUTLIER_DETECTION_MIN_REQUESTS, strconv.Itoa(od.MinRequests)})
+	}
+	if od.EjectionTime != 0 {
+		options = append(options, [2]string{constant.OUTLIER_DETECTION_EJECTION_TIME, od.EjectionTime.String()})
+	}
+	if od.MaxEjectionPercent != 0 {
+		options = append(options, [2]string{constant.OUTLIER_DETECTION_MAX_EJECTION_PERCENT, strconv.Itoa(od.MaxEjectionPercent)})
+	}
+	return options
+}
+
+// 补全默认值并校验后的异常检测配置
+type outlierSettings struct {
+	interval           time.Duration
+	latencyFactor      float64
+	errorRate          float64
+	minRequests        int64
+	ejectionTime       time.Duration
+	maxEjectionPercent int
+}
+
+func (od *outlierDetection) compile() (*outlierSettings, error) {
+	settings := &outlierSettings{
+		interval:           time.Duration(od.Interval),
+		latencyFactor:      constant.DEFAULT_OUTLIER_DETECTION_LATENCY_FACTOR,
+		errorRate:          constant.DEFAULT_OUTLIER_DETECTION_ERROR_RATE,
+		minRequests:        int64(od.MinRequests),
+		ejectionTime:       time.Duration(od.EjectionTime),
+		maxEjectionPercent: od.MaxEjectionPercent,
+	}
+	if settings.interval == 0 {
+		settings.interval = constant.DEFAULT_OUTLIER_DETECTION_INTERVAL
+	}
+	if od.LatencyFactor != nil {
+		settings.latencyFactor = *od.LatencyFactor
+	}
+	if od.ErrorRate != nil {
+		settings.errorRate = *od.ErrorRate
+	}
+	if settings.minRequests == 0 {
+		settings.minRequests = constant.DEFAULT_OUTLIER_DETECTION_MIN_REQUESTS
+	}
+	if settings.ejectionTime == 0 {
+		settings.ejectionTime = constant.DEFAULT_OUTLIER_DETECTION_EJECTION_TIME
+	}
+	if settings.maxEjectionPercent == 0 {
+		settings.maxEjectionPercent = constant.DEFAULT_OUTLIER_DETECTION_MAX_EJECTION_PERCENT
+	}
+	switch {
+	case settings.interval <= 0:
+		return nil, fmt.Errorf("invalid %s %v, must be positive", constant.OUTLIER_DETECTION_INTERVAL, od.Interval)
+	case settings.ejectionTime <= 0:
+		return nil, fmt.Errorf("invalid %s %v, must be positive", constant.OUTLIER_DETECTION_EJECTION_TIME, od.EjectionTime)
+	case settings.latencyFactor != 0 && settings.latencyFactor <= 1:
+		return nil, fmt.Errorf("invalid %s %v, must be 0 or greater than 1", constant.OUTLIER_DETECTION_LATENCY_FACTOR, settings.latencyFactor)
+	case settings.errorRate < 0 || settings.errorRate > 1:
+		return nil, fmt.Errorf("invalid %s %v, must be between 0 and 1", constant.OUTLIER_DETECTION_ERROR_RATE, settings.errorRate)
+	case settings.minRequests < 0:
+		return nil, fmt.Errorf("invalid %s %d", constant.OUTLIER_DETECTION_MIN_REQUESTS, od.MinRequests)
+	case settings.maxEjectionPercent < 0 || settings.maxEjectionPercent > 100:
+		return nil, fmt.Errorf("invalid %s %d, must be between 0 and 100", constant.OUTLIER_DETECTION_MAX_EJECTION_PERCENT, od.MaxEjectionPercent)
+	}
+	return settings, nil
+}
+
+// 每个间隔检测一遍当前的所有后端服务器
+func (upstream *upstream) outlierLoop(ctx context.Context, settings *outlierSettings) {
+	ticker := time.NewTicker(settings.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			upstream.detectOutliers(settings, time.Now())
+		}
+	}
+}
+
+// 参与异常检测的后端服务器的统计
+type outlierSample struct {
+	p         *peer
+	latency   float64
+	errorRate float64
+	measured  bool
+}
+
+// 检测一次：错误率达到error_rate，或者响应时间超过其他后端服务器中位数latency_factor倍的摘除ejection_time，
+// 同时被摘除的不超过max_ejection_percent
+func (upstream *upstream) detectOutliers(settings *outlierSettings, now time.Time) {
+	peers := upstream.state.Load().peers
+	ejected := 0
+	var samples []outlierSample
+	for _, p := range peers {
+		requests := p.stats.takeRequests()
+		if now.UnixNano() < p.ejected.Load() {
+			ejected++
+			continue
+		}
+		if requests < settings.minRequests {
+			continue
+		}
+		latency, errorRate, measured := p.stats.load(now)
+		samples = append(samples, outlierSample{p: p, latency: latency, errorRate: errorRate, measured: measured})
+	}
+	limit := len(peers) * settings.maxEjectionPercent / 100
+	for i, s := range samples {
+		if ejected >= limit {
+			return
+		}
+		var reason string
+		if settings.errorRate > 0 && s.errorRate >= settings.errorRate {
+			reason = fmt.Sprintf("error rate %.2f", s.errorRate)
+		} else if median, ok := medianLatency(samples, i); ok && s.measured && settings.latencyFactor > 0 && s.latency > median*settings.latencyFactor {
+			reason = fmt.Sprintf("latency %v, median of others %v", time.Duration(s.latency), time.Duration(median))
+		}
+		if reason == "" {
+			continue
+		}
+		ejected++
+		until := now.Add(settings.ejectionTime)
+		s.p.ejected.Store(until.UnixNano())
+		s.p.warmUp(until)
+		s.p.stats.reset()
+		logger.Warn("后端服务器池", upstream.name, "后端服务器", s.p.addr, "异常（", reason, "），摘除", settings.ejectionTime)
+	}
+}
+
+// 除了第except个之外的其他后端服务器响应时间的中位数，没有其他后端服务器时ok为false
+func medianLatency(samples []outlierSample, except int) (median float64, ok bool) {
+	var latencies []float64
+	for i, s := range samples {
+		if i != except && s.measured {
+			latencies = append(latencies, s.latency)
+		}
+	}
+	if len(latencies) == 0 {
+		return 0, false
+	}
+	sort.Float64s(latencies)
+	n := len(latencies)
+	if n%2 == 1 {
+		return latencies[n/2], true
+	}
+	return (latencies[n/2-1] + latencies[n/2]) / 2, true
+}
@@ -0,0 +1,209 @@
+package core
+
+//请求失败时重试下一个后端服务器
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 重试配置
+type nextUpstream struct {
+	Conditions string   `json:"conditions,omitempty"` //重试的条件，空格分隔，默认"error timeout"
+	Tries      int      `json:"tries,omitempty"`      //最多尝试的后端服务器数量，0表示不限制
+	Timeout    duration `json:"timeout,omitempty"`    //重试的总时长，0表示不限制
+	BodySize   string   `json:"body_size,omitempty"`  //为了重试缓存的请求体大小上限，默认64k
+}
+
+// 设置重试的配置项
+func (next *nextUpstream) setOption(key, value string) error {
+	switch key {
+	case constant.NEXT_UPSTREAM:
+		if _, err := parseConditions(value); err != nil {
+			return err
+		}
+		next.Conditions = value
+	case constant.NEXT_UPSTREAM_TRIES:
+		tries, err := strconv.Atoi(value)
+		if err != nil || tries < 0 {
+			return fmt.Errorf("%s 字段设置错误：%q is not a number", key, value)
+		}
+		next.Tries = tries
+	case constant.NEXT_UPSTREAM_TIMEOUT:
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		next.Timeout = d
+	case constant.NEXT_UPSTREAM_BODY_SIZE:
+		if _, err := parseSize(value); err != nil {
+			return err
+		}
+		next.BodySize = value
+	default:
+		return fmt.Errorf("unknown key %q in upstream", key)
+	}
+	return nil
+}
+
+// 已设置的配置项，用于输出[server]风格的配置
+func (next *nextUpstream) options() [][2]string {
+	var options [][2]string
+	if next.Conditions != "" {
+		options = append(options, [2]string{constant.NEXT_UPSTREAM, next.Conditions})
+	}
+	if next.Tries != 0 {
+		options = append(options, [2]string{constant.NEXT_UPSTREAM_TRIES, strconv.Itoa(next.Tries)})
+	}
+	if next.Timeout != 0 {
+		options = append(options, [2]string{constant.NEXT_UPSTREAM_TIMEOUT, next.Timeout.String()})
+	}
+	if next.BodySize != "" {
+		options = append(options, [2]string{constant.NEXT_UPSTREAM_BODY_SIZE, next.BodySize})
+	}
+	return options
+}
+
+// 解析后的重试配置
+type retryPolicy struct {
+	error         bool
+	timeout       bool
+	status        map[int]bool
+	nonIdempotent bool
+	tries         int
+	deadline      time.Duration
+	bodySize      int64
+}
+
+// 解析重试条件，例如"error timeout http_502 non_idempotent"
+func parseConditions(value string) (*retryPolicy, error) {
+	policy := &retryPolicy{status: make(map[int]bool)}
+	for _, condition := range strings.Fields(value) {
+		switch {
+		case condition == constant.NEXT_UPSTREAM_OFF:
+			if len(strings.Fields(value)) != 1 {
+				return nil, fmt.Errorf("%s: \"off\" can not be combined with other conditions", constant.NEXT_UPSTREAM)
+			}
+		case condition == constant.NEXT_UPSTREAM_ERROR:
+			policy.error = true
+		case condition == constant.NEXT_UPSTREAM_TIMEOUT_ERROR:
+			policy.timeout = true
+		case condition == constant.NEXT_UPSTREAM_NON_IDEMPOTENT:
+			policy.nonIdempotent = true
+		case strings.HasPrefix(condition, constant.NEXT_UPSTREAM_HTTP_PREFIX):
+			code, err := strconv.Atoi(strings.TrimPrefix(condition, constant.NEXT_UPSTREAM_HTTP_PREFIX))
+			if err != nil || code < 400 || code > 599 {
+				return nil, fmt.Errorf("%s: invalid condition %q", constant.NEXT_UPSTREAM, condition)
+			}
+			policy.status[code] = true
+		default:
+			return nil, fmt.Errorf("%s: unknown condition %q", constant.NEXT_UPSTREAM, condition)
+		}
+	}
+	return policy, nil
+}
+
+// 解析大小，例如"512"、"64k"、"1m"
+func parseSize(value string) (int64, error) {
+	unit := int64(1)
+	number := strings.ToLower(value)
+	switch {
+	case strings.HasSuffix(number, "k"):
+		unit, number = 1024, strings.TrimSuffix(number, "k")
+	case strings.HasSuffix(number, "m"):
+		unit, number = 1024*1024, strings.TrimSuffix(number, "m")
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * unit, nil
+}
+
+// 补全默认值并解析重试配置，next为nil时使用默认配置
+func (next *nextUpstream) compile() (*retryPolicy, error) {
+	if next == nil {
+		next = &nextUpstream{}
+	}
+	conditions := next.Conditions
+	if conditions == "" {
+		conditions = constant.DEFAULT_NEXT_UPSTREAM
+	}
+	policy, err := parseConditions(conditions)
+	if err != nil {
+		return nil, err
+	}
+	policy.tries = next.Tries
+	policy.deadline = time.Duration(next.Timeout)
+	policy.bodySize = constant.DEFAULT_NEXT_UPSTREAM_BODY_SIZE
+	if next.BodySize != "" {
+		if policy.bodySize, err = parseSize(next.BodySize); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// 请求是否允许重试
+func (policy *retryPolicy) allows(r *http.Request) bool {
+	if !policy.error && !policy.timeout && len(policy.status) == 0 {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return policy.nonIdempotent
+}
+
+// 已经尝试了tries个后端服务器，是否还能继续重试
+func (policy *retryPolicy) more(tries int, start time.Time) bool {
+	if policy.tries != 0 && tries >= policy.tries {
+		return false
+	}
+	return policy.deadline == 0 || time.Since(start) < policy.deadline
+}
+
+// 请求错误是否需要重试
+func (policy *retryPolicy) retryError(err error) bool {
+	if isTimeout(err) {
+		return policy.timeout
+	}
+	return policy.error
+}
+
+// 后端服务器返回这个状态码时重试
+type nextUpstreamStatus int
+
+func (status nextUpstreamStatus) Error() string {
+	return fmt.Sprintf("status %d", int(status))
+}
+
+func isNextUpstreamStatus(err error) bool {
+	var status nextUpstreamStatus
+	return errors.As(err, &status)
+}
+
+// 缓存请求体用于重试。请求体超过上限时返回nil，body仍然可以完整读取，但不能重试
+func bufferBody(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, error) {
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, body, err
+	}
+	if int64(len(data)) > limit {
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}, nil
+	}
+	body.Close()
+	return data, nil, nil
+}
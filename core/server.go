@@ -10,15 +10,21 @@ func Init() *Engine {
 // Start 启动服务
 func (e *Engine) Start() {
 	e.startListen()
-	e.wg.Wait()
 }
 
-// Reset 重启动服务，不中断服务。
-func (e *Engine) Reset() {
-	e.resetEngine()
-	e.wg.Wait()
+// Reset 重启动服务，不中断服务。新配置无效或者端口绑定失败时继续使用原来的配置
+func (e *Engine) Reset() error {
+	err := e.resetEngine()
+	if err != nil {
+		logger.Error("热重启失败：", err)
+		return err
+	}
+	logger.Info("热重启成功")
+	return nil
 }
 
+// Stop 停止服务，等待监听配置文件的后台任务退出
 func (e *Engine) Stop() {
 	e.stopEngine()
+	e.watchers.Wait()
 }
@@ -1,11 +1,14 @@
 package core
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hellobchain/nginxgo/common/constant"
@@ -16,45 +19,92 @@ import (
 
 // 启动监听服务
 func (engine *Engine) startListen() {
-	for i := range engine.service {
-		service := &engine.service[i]
-		engine.wg.Add(1)
-		go service.listen(&engine.servicesPoll, &engine.upstream, &engine.wg)
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	for _, service := range engine.service {
+		mux, err := service.buildHandler(&engine.upstream)
+		if err != nil {
+			logger.Error("监听", service.Port, "错误，错误信息：", err)
+			continue
+		}
+		if err := service.bind(); err != nil {
+			logger.Error("监听", service.Port, "错误，错误信息：", err)
+			continue
+		}
+		service.handler.store(mux)
+		engine.servicesPoll[service.Port] = service
+		go service.serve()
 	}
+	engine.state = constant.ENGINE_RUN
 }
 
-// 对每个service进行监听
-func (service *service) listen(servicesPoll *map[string]*service, upstreamMap *map[string]*upstream, wg *sync.WaitGroup) {
+// 可以原子替换的handler，热重启时不需要重新监听端口
+type swapHandler struct {
+	h atomic.Value
+}
+
+func (handler *swapHandler) store(h http.Handler) {
+	handler.h.Store(h)
+}
+
+func (handler *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler.h.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// 构建service的路由
+func (service *service) buildHandler(upstreams *upstreamTable) (handler http.Handler, err error) {
+	//重复的路由会导致ServeMux panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("port %s: %v", service.Port, r)
+		}
+	}()
 	mux := http.NewServeMux()
-	for i := range service.Location {
-		location := &service.Location[i]
-		if (*location).Root == "" {
-			(*location).Root = "/"
+	for _, location := range service.Location {
+		location := location
+		if location.Root == "" {
+			location.Root = "/"
 		}
-		switch (*location).LocationType {
+		switch location.LocationType {
 		case constant.LOCATION_LOADBALANCING:
-			mux.HandleFunc((*location).Root, func(writer http.ResponseWriter, request *http.Request) {
-				(*location).forward(writer, request, &service.mu, upstreamMap)
+			mux.HandleFunc(location.Root, func(writer http.ResponseWriter, request *http.Request) {
+				location.forward(writer, request, upstreams)
 			})
 		case constant.LOCATION_FILESERVICE:
-			mux.HandleFunc((*location).Root, func(writer http.ResponseWriter, request *http.Request) {
-				(*location).getFile(writer, request, &service.mu)
+			mux.HandleFunc(location.Root, func(writer http.ResponseWriter, request *http.Request) {
+				location.getFile(writer, request)
 			})
 		}
 	}
+	return mux, nil
+}
 
-	src := &http.Server{
-		Addr:    ":" + service.Port, //还是和端口绑定了，令人感叹
-		Handler: mux,
+// 绑定端口
+func (service *service) bind() error {
+	listener, err := net.Listen("tcp", ":"+service.Port) //还是和端口绑定了，令人感叹
+	if err != nil {
+		return fmt.Errorf("listen port %s failed: %v", service.Port, err)
+	}
+	service.listener = listener
+	service.handler = &swapHandler{}
+	service.httpService = &http.Server{
+		Handler: service.handler,
 	}
-	service.httpService = src
-	(*servicesPoll)[service.Port] = service
+	return nil
+}
 
-	wg.Done()
+// 关闭服务。Serve可能还没有开始，需要单独关闭监听
+func (service *service) close() error {
+	err := service.httpService.Close()
+	service.listener.Close()
+	return err
+}
 
-	err := src.ListenAndServe()
+// 对每个service进行监听
+func (service *service) serve() {
+	err := service.httpService.Serve(service.listener)
 	if err != nil {
-		if err.Error() == "http: Server closed" {
+		if err == http.ErrServerClosed {
 			return
 		}
 		logger.Error("监听", service.Port, "错误，错误信息：", err)
@@ -62,28 +112,16 @@ func (service *service) listen(servicesPoll *map[string]*service, upstreamMap *m
 }
 
 // 反向代理，将信息转发给后端服务器
-func (location *location) forward(w http.ResponseWriter, r *http.Request, mu *sync.Mutex, upstreamMap *map[string]*upstream) {
+func (location *location) forward(w http.ResponseWriter, r *http.Request, upstreams *upstreamTable) {
 	logRequest(r)
-	//询问是否正在热重启。如果是则返回503，服务器维护状态码。
-	isNotReSet := mu.TryLock()
-	if !isNotReSet {
-		http.Error(w, "服务重启中，请重试", http.StatusServiceUnavailable)
+	//	获取后端服务器池
+	upstream := upstreams.get(location.Upstream)
+	if upstream == nil {
+		logger.Error("后端服务器池", location.Upstream, "不存在")
+		http.Error(w, "后端服务器池不存在", http.StatusBadGateway)
 		return
-	} else {
-		mu.Unlock()
 	}
 
-	//	获取hash环
-	upstream := (*upstreamMap)[location.Upstream]
-	isNotReSet = upstream.mu.TryLock()
-	if !isNotReSet {
-		http.Error(w, "服务重启中，请重试", http.StatusServiceUnavailable)
-		return
-	} else {
-		upstream.mu.Unlock()
-	}
-	hashRing := upstream.hashRing
-
 	// 获取客户端ip
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -92,33 +130,126 @@ func (location *location) forward(w http.ResponseWriter, r *http.Request, mu *sy
 		return
 	}
 
-	// 获取后端服务器
-	serviceIP := hashRing.balancer(ip)
+	// 为了重试缓存请求体，超过上限时不重试
+	key := upstream.hashKey.eval(r, ip)
+	canRetry := upstream.retry.allows(r)
+	var body []byte
+	if canRetry && r.Body != nil && r.Body != http.NoBody {
+		var rest io.ReadCloser
+		body, rest, err = bufferBody(r.Body, upstream.retry.bodySize)
+		if err != nil {
+			logger.Error("读取请求体错误:", err)
+			http.Error(w, "读取请求体错误", http.StatusBadRequest)
+			return
+		}
+		if body == nil {
+			r.Body = rest
+			canRetry = false
+		}
+	}
+
+	// 获取后端服务器，失败时换下一个
+	start := time.Now()
+	tried := make(map[*peer]bool)
+	skip := func(p *peer) bool {
+		return tried[p]
+	}
+	for {
+		//会话保持的cookie指向的后端服务器优先，不可用时按负载均衡策略选择
+		node := upstream.stickyPeer(r, skip)
+		if node == nil {
+			node = upstream.pick(key, skip)
+		}
+		if node == nil {
+			logger.Error("后端服务器池", location.Upstream, "没有可用的后端服务器")
+			if upstream.Fallback != nil {
+				upstream.Fallback.serve(w)
+				return
+			}
+			http.Error(w, "没有可用的后端服务器", http.StatusBadGateway)
+			return
+		}
+		tried[node] = true
+		//半开状态的熔断器只放行有限的探测请求
+		if !node.breaker.acquire() {
+			continue
+		}
+		more := canRetry && upstream.retry.more(len(tried), start) && upstream.hasCandidate(skip)
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if !location.proxy(w, r, upstream, node, more) {
+			return
+		}
+		logger.Warn("后端服务器", node.addr, "请求失败，重试下一个后端服务器")
+	}
+}
+
+// 把请求转发给一个后端服务器。more表示失败时还可以重试，需要重试时返回true，此时没有写入任何响应
+func (location *location) proxy(w http.ResponseWriter, r *http.Request, upstream *upstream, node *peer, more bool) bool {
+	node.inflight.Add(1)
+	defer node.inflight.Add(-1)
+	serviceIP := node.addr
 	remote, err := url.Parse(upstream.Scheme + "://" + serviceIP)
 	if err != nil {
 		logger.Error("解析目标服务器地址失败:", err)
 		http.Error(w, "解析目标服务器地址失败", http.StatusInternalServerError)
-		return
+		return false
 	}
 
 	// 创建反向代理。
+	retry := false
 	proxy := httputil.NewSingleHostReverseProxy(remote)
+	proxy.Transport = upstream.transport
 	// 修改响应头
+	start := time.Now()
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		failed := statusIn(upstream.failStatus, resp.StatusCode)
+		node.stats.observe(time.Since(start), failed)
+		if failed {
+			node.fail(upstream.name, fmt.Errorf("status %d", resp.StatusCode))
+		} else {
+			node.succeed(upstream.name)
+		}
+		//返回错误时由ErrorHandler处理，响应不会写给客户端
+		if more && upstream.retry.status[resp.StatusCode] {
+			return nextUpstreamStatus(resp.StatusCode)
+		}
 		for _, header := range upstream.ProxySetHeader {
 			w.Header().Add(header.HeaderName, header.HeaderValue)
 		}
+		upstream.sticky.issue(resp, r, node)
 		return nil
 	}
-	proxy.ServeHTTP(w, r)
-	if len(w.Header()) == 0 {
-		upstream.failCount[serviceIP] += 1
-		count := upstream.failCount[serviceIP]
-		if count == 3 {
-			logger.Error("后端服务器", serviceIP, "已失效")
-			upstream.del(serviceIP)
+	// 连接错误和超时记为失败，客户端主动断开不算
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() != nil {
+			return
+		}
+		if isNextUpstreamStatus(err) {
+			retry = true
+			return
+		}
+		node.stats.observe(time.Since(start), true)
+		node.fail(upstream.name, err)
+		logger.Error("后端服务器", serviceIP, "请求失败:", err)
+		if more && upstream.retry.retryError(err) {
+			retry = true
+			return
+		}
+		//最后一个后端服务器也失败时使用兜底响应
+		if upstream.Fallback != nil && !upstream.hasCandidate(func(p *peer) bool { return p == node }) {
+			upstream.Fallback.serve(w)
+			return
 		}
+		if isTimeout(err) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
 	}
+	proxy.ServeHTTP(w, r)
+	return retry
 }
 
 func logRequest(r *http.Request) {
@@ -0,0 +1,49 @@
+package core
+
+//慢启动：恢复或者新加入的后端服务器在slow_start内从0逐渐增加到完整的流量
+
+import (
+	"math/rand"
+	"time"
+)
+
+// 从t开始慢启动
+func (p *peer) warmUp(t time.Time) {
+	p.warmFrom.Store(t.UnixNano())
+}
+
+// 慢启动中的有效权重比例，0到1，不在慢启动中时为1
+func (p *peer) warmth(now time.Time, slowStart time.Duration) float64 {
+	from := p.warmFrom.Load()
+	if from == 0 || slowStart == 0 {
+		return 1
+	}
+	elapsed := now.UnixNano() - from
+	if elapsed >= int64(slowStart) {
+		p.warmFrom.CompareAndSwap(from, 0)
+		return 1
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(slowStart)
+}
+
+// 这次请求要跳过的慢启动中的后端服务器：有效权重比例为w的服务器以1-w的概率跳过，
+// 对所有策略都相当于把它的流量按比例减少。没有要跳过的服务器时返回nil
+func (upstream *upstream) warming(peers []*peer) map[*peer]bool {
+	if upstream.SlowStart == 0 {
+		return nil
+	}
+	var warming map[*peer]bool
+	now := time.Now()
+	for _, p := range peers {
+		if w := p.warmth(now, time.Duration(upstream.SlowStart)); w < 1 && rand.Float64() >= w {
+			if warming == nil {
+				warming = make(map[*peer]bool)
+			}
+			warming[p] = true
+		}
+	}
+	return warming
+}
@@ -0,0 +1,142 @@
+package core
+
+//配置快照：每次成功生效的配置都保存一份，用于查看历史和回滚
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+var ConfigHistoryDir string
+
+// Snapshot 一份生效过的配置
+type Snapshot struct {
+	ID     string          `json:"id"`
+	Time   time.Time       `json:"time"`
+	Hash   string          `json:"hash"`   //配置内容的sha256
+	Source string          `json:"source"` //生效时的配置文件
+	Config json.RawMessage `json:"config"` //合并include之后的配置，环境变量保持原样，不落盘密钥
+}
+
+// 快照中保存的配置：替换过变量的值还原为原始写法，不落盘密钥。
+// 在切换之前调用，之后运行时的修改和配置文件的变化都不会进入快照
+func snapshotConfig(cfg config) []byte {
+	data, _ := json.Marshal(cfg)
+	return []byte(unexpand(string(data), cfg.templates))
+}
+
+// 保存生效的配置的快照，data来自snapshotConfig，内容与最近一次快照相同时跳过
+func saveSnapshot(data []byte, fileName string) (*Snapshot, error) {
+	if ConfigHistoryDir == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	snapshots, err := ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) > 0 && snapshots[len(snapshots)-1].Hash == hash {
+		return snapshots[len(snapshots)-1], nil
+	}
+	now := time.Now()
+	snapshot := &Snapshot{
+		ID:     now.Format("20060102150405") + "-" + hash[:8],
+		Time:   now,
+		Hash:   hash,
+		Source: fileName,
+		Config: data,
+	}
+	content, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(ConfigHistoryDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(ConfigHistoryDir, snapshot.ID+".json"), content, 0600); err != nil {
+		return nil, err
+	}
+	//只保留最近的快照
+	snapshots = append(snapshots, snapshot)
+	for len(snapshots) > constant.MAX_CONFIG_SNAPSHOTS {
+		os.Remove(filepath.Join(ConfigHistoryDir, snapshots[0].ID+".json"))
+		snapshots = snapshots[1:]
+	}
+	return snapshot, nil
+}
+
+// ListSnapshots 按时间顺序列出所有快照
+func ListSnapshots() ([]*Snapshot, error) {
+	entries, err := os.ReadDir(ConfigHistoryDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshots []*Snapshot
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		snapshot, err := loadSnapshot(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+func loadSnapshot(id string) (*Snapshot, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("invalid snapshot id %q", id)
+	}
+	data, err := os.ReadFile(filepath.Join(ConfigHistoryDir, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("snapshot %q not found", id)
+		}
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("snapshot %q: %v", id, err)
+	}
+	return &snapshot, nil
+}
+
+// RestoreSnapshot 把快照写回配置文件，格式由配置文件的扩展名决定，原文件备份为.bak
+func RestoreSnapshot(id, fileName string) error {
+	snapshot, err := loadSnapshot(id)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseJsonConfig(id, snapshot.Config, &configReader{raw: true})
+	if err != nil {
+		return err
+	}
+	data, err := marshalConfig(cfg, fileName)
+	if err != nil {
+		return err
+	}
+	if old, err := os.ReadFile(fileName); err == nil {
+		if err := os.WriteFile(fileName+".bak", old, 0644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
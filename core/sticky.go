@@ -0,0 +1,206 @@
+package core
+
+//会话保持：第一次响应时下发签名的cookie记录选中的后端服务器，之后的请求按cookie转发，
+//cookie指向的后端服务器不可用或者已删除时按负载均衡策略重新选择
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 会话保持配置
+type sticky struct {
+	Cookie   string   `json:"cookie"`             //cookie名
+	Expires  duration `json:"expires,omitempty"`  //有效期，不设置时为会话cookie
+	Path     string   `json:"path,omitempty"`     //路径，默认"/"
+	Domain   string   `json:"domain,omitempty"`   //域名
+	Secure   bool     `json:"secure,omitempty"`   //只通过https发送
+	HttpOnly bool     `json:"httponly,omitempty"` //不允许脚本读取
+	Secret   string   `json:"secret,omitempty"`   //签名密钥，不设置时每次启动随机生成，重启后原来的cookie失效
+}
+
+// 输出日志时的替换表：替换过变量的值还原为原始写法，签名密钥一律隐藏，避免有日志权限的人伪造cookie
+func logTemplates(cfg config) map[string]string {
+	templates := make(map[string]string, len(cfg.templates))
+	for value, template := range cfg.templates {
+		templates[value] = template
+	}
+	mask := func(u *upstream) {
+		if u != nil && u.Sticky != nil && u.Sticky.Secret != "" {
+			templates[u.Sticky.Secret] = constant.MASKED_VALUE
+		}
+	}
+	mask(cfg.UpstreamDefault)
+	for _, u := range cfg.Upstream {
+		mask(u)
+	}
+	return templates
+}
+
+// 设置会话保持的配置项，"sticky"的值为"cookie 名称 属性..."
+func (st *sticky) setOption(key, value string) error {
+	switch key {
+	case constant.STICKY:
+		fields := strings.Fields(value)
+		if len(fields) < 2 || fields[0] != constant.STICKY_COOKIE {
+			return fmt.Errorf("invalid %s %q, expecting \"%s name [attributes]\"", key, value, constant.STICKY_COOKIE)
+		}
+		st.Cookie = fields[1]
+		for _, field := range fields[2:] {
+			name, arg, _ := strings.Cut(field, "=")
+			switch name {
+			case constant.STICKY_EXPIRES:
+				d, err := parseDuration(arg)
+				if err != nil {
+					return err
+				}
+				st.Expires = d
+			case constant.STICKY_PATH:
+				st.Path = arg
+			case constant.STICKY_DOMAIN:
+				st.Domain = arg
+			case constant.STICKY_SECURE:
+				st.Secure = true
+			case constant.STICKY_HTTPONLY:
+				st.HttpOnly = true
+			default:
+				return fmt.Errorf("unknown %s attribute %q", key, field)
+			}
+		}
+	case constant.STICKY_SECRET:
+		st.Secret = value
+	default:
+		return fmt.Errorf("unknown key %q in upstream", key)
+	}
+	return nil
+}
+
+// 已设置的配置项，用于输出[server]风格的配置
+func (st *sticky) options() [][2]string {
+	fields := []string{constant.STICKY_COOKIE, st.Cookie}
+	if st.Expires != 0 {
+		fields = append(fields, constant.STICKY_EXPIRES+"="+st.Expires.String())
+	}
+	if st.Path != "" {
+		fields = append(fields, constant.STICKY_PATH+"="+st.Path)
+	}
+	if st.Domain != "" {
+		fields = append(fields, constant.STICKY_DOMAIN+"="+st.Domain)
+	}
+	if st.Secure {
+		fields = append(fields, constant.STICKY_SECURE)
+	}
+	if st.HttpOnly {
+		fields = append(fields, constant.STICKY_HTTPONLY)
+	}
+	options := [][2]string{{constant.STICKY, strings.Join(fields, " ")}}
+	if st.Secret != "" {
+		options = append(options, [2]string{constant.STICKY_SECRET, st.Secret})
+	}
+	return options
+}
+
+// 没有设置sticky_secret时使用的密钥，进程内所有后端服务器池共用，热重启后cookie仍然有效
+var stickyRandomKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// 校验并解析后的会话保持配置
+type stickySettings struct {
+	cookie   http.Cookie //下发的cookie模板，Value为空
+	key      []byte
+	upstream string
+}
+
+func (st *sticky) compile(upstream string) (*stickySettings, error) {
+	if st.Cookie == "" || strings.ContainsAny(st.Cookie, " \t\r\n=;,\"") {
+		return nil, fmt.Errorf("invalid %s cookie name %q", constant.STICKY, st.Cookie)
+	}
+	settings := &stickySettings{
+		cookie: http.Cookie{
+			Name:     st.Cookie,
+			Path:     st.Path,
+			Domain:   st.Domain,
+			Secure:   st.Secure,
+			HttpOnly: st.HttpOnly,
+			SameSite: http.SameSiteLaxMode,
+		},
+		key:      []byte(st.Secret),
+		upstream: upstream,
+	}
+	if settings.cookie.Path == "" {
+		settings.cookie.Path = "/"
+	}
+	if st.Expires != 0 {
+		settings.cookie.MaxAge = int((time.Duration(st.Expires) + time.Second - 1) / time.Second)
+	}
+	if len(settings.key) == 0 {
+		settings.key = stickyRandomKey
+	}
+	return settings, nil
+}
+
+// 后端服务器的标识：后端服务器池名和地址的HMAC，不暴露地址，不知道密钥时无法伪造
+func (settings *stickySettings) id(addr string) string {
+	mac := hmac.New(sha256.New, settings.key)
+	mac.Write([]byte(settings.upstream + "\x00" + addr))
+	return hex.EncodeToString(mac.Sum(nil)[:constant.STICKY_ID_BYTES])
+}
+
+// 标识到后端服务器的映射，重建负载均衡器时生成
+func (settings *stickySettings) index(peers []*peer) map[string]*peer {
+	if settings == nil {
+		return nil
+	}
+	index := make(map[string]*peer, len(peers))
+	for _, p := range peers {
+		index[settings.id(p.addr)] = p
+	}
+	return index
+}
+
+// cookie指向的后端服务器，没有cookie、签名不对、已删除或者不可用时返回nil
+func (upstream *upstream) stickyPeer(r *http.Request, skip func(*peer) bool) *peer {
+	if upstream.sticky == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(upstream.sticky.cookie.Name)
+	if err != nil {
+		return nil
+	}
+	state := upstream.state.Load()
+	if state == nil {
+		return nil
+	}
+	p := state.sticky[cookie.Value]
+	if p == nil || !p.available() || skip != nil && skip(p) {
+		return nil
+	}
+	return p
+}
+
+// 请求没有带指向node的cookie时，在响应中下发
+func (settings *stickySettings) issue(resp *http.Response, r *http.Request, node *peer) {
+	if settings == nil {
+		return
+	}
+	id := settings.id(node.addr)
+	if cookie, err := r.Cookie(settings.cookie.Name); err == nil && cookie.Value == id {
+		return
+	}
+	cookie := settings.cookie
+	cookie.Value = id
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
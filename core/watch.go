@@ -0,0 +1,119 @@
+package core
+
+//监听配置文件变化，自动热重启
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hellobchain/nginxgo/common/constant"
+)
+
+// 文件状态
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+// 需要监听的文件
+type watchList struct {
+	files []string //配置文件、include进来的文件和引用的密钥文件
+	globs []string //include使用的glob，用于发现新增的文件
+}
+
+// 解析配置文件得到需要监听的文件。配置有错误时也尽量收集，修好之后能够自动重启
+func newWatchList(fileName string) watchList {
+	reader := &configReader{}
+	reader.parse(fileName)
+	files := reader.files
+	if len(files) == 0 {
+		files = []string{fileName}
+	}
+	return watchList{files: files, globs: reader.globs}
+}
+
+// 所有文件的当前状态，包括glob新匹配到的文件
+func (list watchList) stamps() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	stat := func(path string) {
+		info, err := os.Stat(path)
+		if err != nil {
+			stamps[path] = fileStamp{}
+			return
+		}
+		stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size(), exists: true}
+	}
+	for _, file := range list.files {
+		stat(file)
+	}
+	for _, pattern := range list.globs {
+		matches, _ := filepath.Glob(pattern)
+		for _, file := range matches {
+			if abs, err := filepath.Abs(file); err == nil {
+				file = abs
+			}
+			stat(file)
+		}
+	}
+	return stamps
+}
+
+func sameStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, stamp := range a {
+		other, ok := b[path]
+		if !ok || other != stamp {
+			return false
+		}
+	}
+	return true
+}
+
+// Watch 监听配置文件以及include的文件、引用的密钥文件，
+// 文件变化后等待一段时间没有新的写入再热重启。新配置无效时继续使用原来的配置
+func (e *Engine) Watch() {
+	e.startWatch(constant.WATCH_INTERVAL, constant.WATCH_DEBOUNCE)
+}
+
+// 先同步记录文件的初始状态，再在后台检查变化
+func (e *Engine) startWatch(interval, debounce time.Duration) {
+	list := newWatchList(NginxConfigFilepath)
+	last := list.stamps()
+	e.watchers.Add(1)
+	go func() {
+		defer e.watchers.Done()
+		e.watch(list, last, interval, debounce)
+	}()
+}
+
+func (e *Engine) watch(list watchList, last map[string]fileStamp, interval, debounce time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var changedAt time.Time
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+		now := list.stamps()
+		if !sameStamps(now, last) {
+			//还在写入，重新计时
+			last = now
+			changedAt = time.Now()
+			continue
+		}
+		if changedAt.IsZero() || time.Since(changedAt) < debounce {
+			continue
+		}
+		changedAt = time.Time{}
+		logger.Info("配置文件发生变化，开始热重启")
+		e.Reset()
+		list = newWatchList(NginxConfigFilepath)
+		last = list.stamps()
+	}
+}
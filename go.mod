@@ -1,12 +1,13 @@
 module github.com/hellobchain/nginxgo
 
-go 1.19
+go 1.21
 
 require (
 	github.com/google/uuid v1.6.0
 	github.com/hellobchain/wswlog v0.0.0-20250316041106-9c00e4e92e5b
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/pflag v1.0.5
+	sigs.k8s.io/yaml v1.4.0
 )
 
 require (